@@ -2,18 +2,35 @@
 package main
 
 import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unsafe"
 
 	"crypto/rand"
 	"encoding/hex"
+	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v3"
 )
 
@@ -25,51 +42,120 @@ const (
 
 // Config represents the main configuration structure
 type Config struct {
+	Version     int               `yaml:"version" schema:"min=0"`
+	Include     []string          `yaml:"include,omitempty"`
 	General     GeneralConfig     `yaml:"general"`
+	Defaults    DirectoryConfig   `yaml:"defaults,omitempty"`
 	Directories []DirectoryConfig `yaml:"directories"`
 	Security    SecurityConfig    `yaml:"security"`
+
+	// Profiles are named variants selected with --profile
+	Profiles map[string]ProfileConfig `yaml:"profiles,omitempty"`
+
+	// Warnings about older configuration layouts upgraded while loading
+	Warnings []string `yaml:"-"`
+}
+
+// ProfileConfig overrides the directories and security settings when selected
+type ProfileConfig struct {
+	Directories []DirectoryConfig `yaml:"directories,omitempty"`
+	Security    SecurityConfig    `yaml:"security,omitempty"`
 }
 
 // GeneralConfig contains general program settings
 type GeneralConfig struct {
 	Enabled bool          `yaml:"enabled"`
+	Workers int           `yaml:"workers,omitempty" schema:"min=0"`
 	Logging LoggingConfig `yaml:"logging"`
+
+	// Limits for the whole run, across all directories
+	MaxRuntime   string `yaml:"max_runtime,omitempty" schema:"duration"`
+	MaxDeletions int    `yaml:"max_deletions,omitempty" schema:"min=0"`
+	MaxBytes     string `yaml:"max_bytes,omitempty" schema:"size"`
+
+	// Directories that must not be processed, in addition to the built-in ones
+	ProtectedPaths []string `yaml:"protected_paths,omitempty"`
 }
 
 // LoggingConfig contains logging settings
 type LoggingConfig struct {
 	Enabled bool   `yaml:"enabled"`
-	Level   string `yaml:"level"`
+	Level   string `yaml:"level" schema:"enum=logging_level,nocase"`
 	File    string `yaml:"file"`
 }
 
 // DirectoryConfig contains settings for a directory to process
 type DirectoryConfig struct {
 	Path            string `yaml:"path"`
-	RetentionPeriod string `yaml:"retention_period"`
+	RetentionPeriod string `yaml:"retention_period" schema:"duration"`
 	FilePattern     string `yaml:"file_pattern"`
 	ExcludeSubdirs  bool   `yaml:"exclude_subdirs"`
 	RemoveEmptyDirs bool   `yaml:"remove_empty_dirs"`
+	OneFileSystem   bool   `yaml:"one_file_system,omitempty"`
+	Schedule        string `yaml:"schedule,omitempty" schema:"schedule"`
+
+	// QuarantinePeriod moves expired files into a quarantine directory in
+	// the root and deletes them only once it has passed
+	QuarantinePeriod string `yaml:"quarantine_period,omitempty" schema:"duration"`
+
+	// Limits for one run of this directory
+	MaxRuntime   string `yaml:"max_runtime,omitempty" schema:"duration"`
+	MaxDeletions int    `yaml:"max_deletions,omitempty" schema:"min=0"`
+	MaxBytes     string `yaml:"max_bytes,omitempty" schema:"size"`
+
+	// Mass-deletion guard: refuse to delete more than MassDeletePercent
+	// (default 80) of the files in the directory unless allowed, or unless
+	// fewer than MassDeleteMinFiles (default 0) files would be deleted
+	AllowMassDelete    bool `yaml:"allow_mass_delete,omitempty"`
+	MassDeletePercent  int  `yaml:"mass_delete_percent,omitempty" schema:"min=0,max=100"`
+	MassDeleteMinFiles int  `yaml:"mass_delete_min_files,omitempty" schema:"min=0"`
+
+	// AllowProtectedPath permits a path that is protected, built in or by
+	// general.protected_paths
+	AllowProtectedPath bool `yaml:"allow_protected_path,omitempty"`
+
+	// Security overrides the global security settings for this entry only
+	Security *SecurityConfig `yaml:"security,omitempty"`
+}
+
+// EffectiveSecurity returns the security settings that apply to a directory entry
+func (d DirectoryConfig) EffectiveSecurity(global SecurityConfig) SecurityConfig {
+	if d.Security != nil {
+		return *d.Security
+	}
+	return global
 }
 
-// SecurityConfig contains security settings
+// SecurityConfig contains security settings. The json tags are used in plan files.
 type SecurityConfig struct {
-	DryRun       bool               `yaml:"dry_run"`
-	SecureDelete SecureDeleteConfig `yaml:"secure_delete"`
+	DryRun       bool               `yaml:"dry_run" json:"dry_run"`
+	SecureDelete SecureDeleteConfig `yaml:"secure_delete" json:"secure_delete"`
 }
 
 // SecureDeleteConfig contains secure deletion settings
 type SecureDeleteConfig struct {
-	Enabled            bool `yaml:"enabled"`
-	Passes             int  `yaml:"passes"`
-	ObfuscateFilenames bool `yaml:"obfuscate_filenames"`
+	Enabled            bool   `yaml:"enabled" json:"enabled"`
+	Passes             int    `yaml:"passes" json:"passes" schema:"min=0"`
+	ObfuscateFilenames bool   `yaml:"obfuscate_filenames" json:"obfuscate_filenames"`
+	HardlinkPolicy     string `yaml:"hardlink_policy" json:"hardlink_policy,omitempty" schema:"enum=hardlink_policy"`
+	Workers            int    `yaml:"workers" json:"workers,omitempty" schema:"min=0"`
+	MaxBytesPerSecond  string `yaml:"max_bytes_per_second" json:"max_bytes_per_second,omitempty" schema:"size"`
 }
 
+// Hardlink policies for secure deletion of files with links outside the run
+const (
+	HardlinkPolicySkip   = "skip"   // leave the file and all its links untouched
+	HardlinkPolicyUnlink = "unlink" // remove the link without overwriting the data
+	HardlinkPolicyShred  = "shred"  // overwrite the data anyway, destroying every link
+)
+
 // Global variables
 var (
 	isRoot     bool
 	configDir  string
 	configFile string
+	dropInDir  string
+	lockFile   string
 )
 
 // Init determines if the program is running as root and sets the appropriate config paths
@@ -84,6 +170,8 @@ func init() {
 	if isRoot {
 		configDir = "/etc/filekeeper"
 		configFile = filepath.Join(configDir, "filekeeper.yaml")
+		dropInDir = filepath.Join(configDir, "conf.d")
+		lockFile = "/run/filekeeper.lock"
 	} else {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
@@ -91,6 +179,8 @@ func init() {
 		}
 		configDir = filepath.Join(homeDir, ".config")
 		configFile = filepath.Join(configDir, "filekeeper.yaml")
+		dropInDir = filepath.Join(configDir, "filekeeper.d")
+		lockFile = filepath.Join(configDir, "filekeeper.lock")
 	}
 }
 
@@ -130,6 +220,263 @@ func ParseDuration(durationStr string) (time.Duration, error) {
 	return duration, nil
 }
 
+// ParseSize parses a size string like "512", "64K", "50MB", "1GiB" into bytes
+func ParseSize(sizeStr string) (int64, error) {
+	// Check for empty string
+	if sizeStr == "" {
+		return 0, fmt.Errorf("empty size string")
+	}
+
+	// Split the numeric part from the unit
+	str := strings.TrimSpace(sizeStr)
+	i := 0
+	for i < len(str) && str[i] >= '0' && str[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("invalid size format: %s", sizeStr)
+	}
+
+	var value int64
+	if _, err := fmt.Sscanf(str[:i], "%d", &value); err != nil {
+		return 0, fmt.Errorf("invalid size format: %s", sizeStr)
+	}
+
+	// Units are binary multiples (K = KB = KiB = 1024 bytes)
+	var multiplier int64
+	switch strings.ToUpper(strings.TrimSpace(str[i:])) {
+	case "", "B":
+		multiplier = 1
+	case "K", "KB", "KIB":
+		multiplier = 1 << 10
+	case "M", "MB", "MIB":
+		multiplier = 1 << 20
+	case "G", "GB", "GIB":
+		multiplier = 1 << 30
+	case "T", "TB", "TIB":
+		multiplier = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size unit: %s", sizeStr)
+	}
+	if value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size too large: %s", sizeStr)
+	}
+
+	return value * multiplier, nil
+}
+
+// Schedule computes when a directory entry runs in daemon mode
+type Schedule interface {
+	// Next returns the first run time after t, or the zero time if there is none
+	Next(t time.Time) time.Time
+}
+
+// intervalSchedule runs at a fixed interval
+type intervalSchedule struct {
+	every time.Duration
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.every)
+}
+
+// cronSchedule runs at the times matching a cron expression. Each field is a
+// bit set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// cronMacros are the cron expressions the @ shorthands stand for
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// ParseSchedule parses a schedule: a cron expression with five fields
+// (minute hour day-of-month month day-of-week), one of the @hourly, @daily,
+// @weekly, @monthly or @yearly shorthands, or an interval such as "6h" or
+// "@every 30m"
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, fmt.Errorf("empty schedule")
+	}
+
+	// Intervals are a single duration, optionally after @every
+	every := ""
+	if strings.HasPrefix(spec, "@every ") {
+		every = strings.TrimSpace(strings.TrimPrefix(spec, "@every "))
+	} else if !strings.HasPrefix(spec, "@") && len(strings.Fields(spec)) == 1 {
+		every = spec
+	}
+	if every != "" {
+		interval, err := ParseDuration(every)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule interval '%s': %v", spec, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("schedule interval must be positive: %s", spec)
+		}
+		return intervalSchedule{every: interval}, nil
+	}
+
+	expr := spec
+	if strings.HasPrefix(spec, "@") {
+		var ok bool
+		if expr, ok = cronMacros[strings.ToLower(spec)]; !ok {
+			return nil, fmt.Errorf("unknown schedule '%s'", spec)
+		}
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s': expected 5 fields, got %d", spec, len(fields))
+	}
+
+	var schedule cronSchedule
+	var err error
+	if schedule.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': minute: %v", spec, err)
+	}
+	if schedule.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': hour: %v", spec, err)
+	}
+	if schedule.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': day of month: %v", spec, err)
+	}
+	if schedule.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': month: %v", spec, err)
+	}
+	if schedule.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("invalid cron expression '%s': day of week: %v", spec, err)
+	}
+
+	// Sunday may be written as 0 or 7
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domStar = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+	schedule.dowStar = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+
+	return schedule, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges (a-b) and
+// steps (*/n, a-b/n) into a bit set. names, if given, are accepted for the
+// values starting at min.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value '%s'", s)
+		}
+		if n < min || n > max {
+			return 0, fmt.Errorf("value %d out of range %d-%d", n, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step '%s'", stepPart)
+			}
+			step = n
+		}
+
+		var first, last int
+		if rangePart == "*" {
+			first, last = min, max
+		} else if from, to, isRange := strings.Cut(rangePart, "-"); isRange {
+			var err error
+			if first, err = value(from); err != nil {
+				return 0, err
+			}
+			if last, err = value(to); err != nil {
+				return 0, err
+			}
+			if first > last {
+				return 0, fmt.Errorf("invalid range '%s'", rangePart)
+			}
+		} else {
+			n, err := value(rangePart)
+			if err != nil {
+				return 0, err
+			}
+			first, last = n, n
+			if hasStep {
+				last = max
+			}
+		}
+
+		for n := first; n <= last; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+
+	return bits, nil
+}
+
+// Next returns the first time after t matching the expression, searching
+// up to five years ahead
+func (s cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// dayMatches reports whether the day of t matches. As in cron, when both day
+// fields are restricted a day matching either one is enough.
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
 // GetDefaultConfig returns a default configuration
 func GetDefaultConfig() Config {
 	logFile := "/var/log/filekeeper.log"
@@ -139,8 +486,10 @@ func GetDefaultConfig() Config {
 	}
 
 	return Config{
+		Version: CurrentConfigVersion,
 		General: GeneralConfig{
 			Enabled: true,
+			Workers: 1,
 			Logging: LoggingConfig{
 				Enabled: true,
 				Level:   "info",
@@ -162,6 +511,9 @@ func GetDefaultConfig() Config {
 				Enabled:            false,
 				Passes:             3,
 				ObfuscateFilenames: false,
+				HardlinkPolicy:     HardlinkPolicySkip,
+				Workers:            1,
+				MaxBytesPerSecond:  "0",
 			},
 		},
 	}
@@ -183,10 +535,22 @@ func WriteExampleConfig(configPath string) error {
 	// }
 
 	// Add comments to the yaml file
-	configWithComments := `# General settings
+	configWithComments := `# Configuration schema version
+version: ` + strconv.Itoa(config.Version) + `
+
+# General settings
 general:
   # Enable/disable program operation
   enabled: true
+  # Number of directories processed in parallel (overlapping paths always run one after another)
+  workers: 1
+  # Stop the run after this long, this many deletions or this much data (optional)
+  # max_runtime: "2h"
+  # max_deletions: 100000
+  # max_bytes: "500GB"
+  # Directories that must never be processed, in addition to system directories (optional)
+  # protected_paths:
+  #   - "/srv/database"
   # Logging settings
   logging:
     # Enable/disable logging
@@ -207,6 +571,22 @@ directories:
     exclude_subdirs: false
     # Remove empty directories?
     remove_empty_dirs: true
+    # Don't descend into other filesystems mounted inside the directory (optional)
+    # one_file_system: true
+    # Move expired files into a quarantine and delete them after this grace period (optional)
+    # quarantine_period: "7d"
+    # When to run in daemon mode (optional, cron expression or interval such as 6h)
+    # schedule: "0 3 * * *"
+    # Limits for this directory alone (optional, same settings as in general)
+    # max_deletions: 10000
+    # Refuse to run when more than this percentage of the files would be deleted (default 80)
+    # mass_delete_percent: 80
+    # ...but only once at least this many files would be deleted (default 0)
+    # mass_delete_min_files: 0
+    # Security settings for this directory only (optional, overrides the global ones)
+    # security:
+    #   secure_delete:
+    #     enabled: true
 
 # Security settings
 security:
@@ -220,11 +600,58 @@ security:
     passes: 3
     # Obfuscate filenames before deletion to protect sensitive information in names
     obfuscate_filenames: false
+    # What to do with files that have hard links outside the run (skip, unlink, shred)
+    hardlink_policy: "skip"
+    # Number of files overwritten in parallel
+    workers: 1
+    # Combined overwrite throughput limit for all workers (e.g. 50MB, 0 = unlimited)
+    max_bytes_per_second: "0"
 `
 
 	return os.WriteFile(configPath, []byte(configWithComments), 0644)
 }
 
+// WriteExampleConfigFormat writes a default configuration file in the given
+// format. YAML files keep the explanatory comments.
+func WriteExampleConfigFormat(configPath, format string) error {
+	if format == "" || format == FormatYAML {
+		return WriteExampleConfig(configPath)
+	}
+
+	// Convert the default configuration into generic settings
+	config := GetDefaultConfig()
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case FormatJSON:
+		encoded, err := json.MarshalIndent(raw, "", "  ")
+		if err != nil {
+			return err
+		}
+		buf.Write(encoded)
+		buf.WriteString("\n")
+	case FormatTOML:
+		if err := toml.NewEncoder(&buf).Encode(raw); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported configuration format '%s' (expected yaml, json or toml)", format)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, buf.Bytes(), 0644)
+}
+
 // CreateSystemdFiles creates the systemd service and timer files
 func CreateSystemdFiles(userMode bool) error {
 	var systemdDir string
@@ -351,309 +778,5136 @@ RandomizedDelaySec=1hour
 WantedBy=timers.target`)
 }
 
-// LoadConfig loads the configuration from a file
+// LoadConfig loads the configuration from a file together with the files it
+// includes. The default configuration file also picks up the drop-in directory.
 func LoadConfig(configPath string) (Config, error) {
-	data, err := os.ReadFile(configPath)
+	return LoadConfigProfile(configPath, "")
+}
+
+// LoadConfigProfile loads the configuration like LoadConfig and applies the
+// named profile on top of it. An empty name selects no profile.
+func LoadConfigProfile(configPath, profile string) (Config, error) {
+	loader, err := loadConfigFiles(configPath)
 	if err != nil {
 		return Config{}, err
 	}
 
-	config := Config{}
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	config, err := loader.decode(profile)
+	if err != nil {
 		return Config{}, err
 	}
 
-	return config, nil
-}
-
-// obfuscateFilename renames a file to a random name in the same directory before deletion
-func obfuscateFilename(path string, logger *log.Logger) (string, error) {
-	dir := filepath.Dir(path)
-
-	// Generate random name
-	randomBytes := make([]byte, 16)
-	if _, err := rand.Read(randomBytes); err != nil {
-		return "", fmt.Errorf("failed to generate random name: %v", err)
-	}
-
-	randomName := hex.EncodeToString(randomBytes)
-
-	// Generate a random extension too (5 characters)
-	extRandomBytes := make([]byte, 3)
-	if _, err := rand.Read(extRandomBytes); err != nil {
-		return "", fmt.Errorf("failed to generate random extension: %v", err)
+	if err := expandConfigPaths(&config); err != nil {
+		return Config{}, err
 	}
-	randomExt := "." + hex.EncodeToString(extRandomBytes)[:5]
-
-	newPath := filepath.Join(dir, randomName+randomExt)
-
-	// Rename the file
-	if err := os.Rename(path, newPath); err != nil {
-		return "", fmt.Errorf("failed to rename file: %v", err)
+	if err := checkProtectedPaths(config); err != nil {
+		return Config{}, err
 	}
 
-	return newPath, nil
+	return config, nil
 }
 
-// obfuscateDirectoryName renames a directory to a random name in its parent directory
-func obfuscateDirectoryName(dirPath string, logger *log.Logger) (string, error) {
-	parentDir := filepath.Dir(dirPath)
-
-	// Generate random name
-	randomBytes := make([]byte, 16)
-	if _, err := rand.Read(randomBytes); err != nil {
-		return "", fmt.Errorf("failed to generate random name: %v", err)
+// expandConfigPaths expands home directories and environment variables in path settings
+func expandConfigPaths(config *Config) error {
+	if config.General.Logging.File != "" {
+		expanded, err := ExpandPath(config.General.Logging.File)
+		if err != nil {
+			return fmt.Errorf("general.logging.file: %v", err)
+		}
+		config.General.Logging.File = expanded
 	}
 
-	randomName := hex.EncodeToString(randomBytes)
-	newPath := filepath.Join(parentDir, randomName)
-
-	// Rename the directory
-	if err := os.Rename(dirPath, newPath); err != nil {
-		return "", fmt.Errorf("failed to rename directory: %v", err)
+	for i := range config.Directories {
+		expanded, err := ExpandPath(config.Directories[i].Path)
+		if err != nil {
+			return fmt.Errorf("directories[%d].path: %v", i, err)
+		}
+		config.Directories[i].Path = expanded
 	}
 
-	return newPath, nil
+	return nil
 }
 
-// ProcessDirectory processes a directory according to its configuration
-func ProcessDirectory(dirConfig DirectoryConfig, securityConfig SecurityConfig, logger *log.Logger) error {
-	logger.Printf("Processing directory: %s", dirConfig.Path)
+// builtinProtectedPaths are directories that are never processed as a whole,
+// usually the result of a typo. Directories inside them can be configured.
+var builtinProtectedPaths = []string{
+	"/", "/bin", "/boot", "/dev", "/etc", "/home", "/home/*", "/lib", "/lib32",
+	"/lib64", "/libx32", "/media", "/mnt", "/opt", "/proc", "/root", "/run",
+	"/sbin", "/srv", "/sys", "/usr", "/usr/*", "/var", "/var/lib",
+}
 
-	// Check if directory exists
-	if _, err := os.Stat(dirConfig.Path); os.IsNotExist(err) {
-		return fmt.Errorf("directory does not exist: %s", dirConfig.Path)
+// checkProtectedPaths refuses directory entries whose path, or the directory
+// it resolves to, is a built-in protected directory or the home directory,
+// or overlaps general.protected_paths. Glob paths are checked for every
+// current match. Entries with allow_protected_path are not checked.
+func checkProtectedPaths(config Config) error {
+	protected, err := protectedPathList(config)
+	if err != nil {
+		return err
 	}
 
-	// Parse retention period
-	retention, err := ParseDuration(dirConfig.RetentionPeriod)
-	if err != nil {
-		return fmt.Errorf("invalid retention period '%s': %v", dirConfig.RetentionPeriod, err)
+	for i, dir := range config.Directories {
+		if dir.AllowProtectedPath || dir.Path == "" {
+			continue
+		}
+		paths := []string{dir.Path}
+		if strings.ContainsAny(dir.Path, "*?[") {
+			// Invalid patterns are reported when the entry is processed
+			paths, _ = filepath.Glob(dir.Path)
+		}
+		for _, path := range paths {
+			if reason := protectedPath(path, protected); reason != "" {
+				return fmt.Errorf("directories[%d].path: %s; set allow_protected_path: true on the entry to process it anyway", i, reason)
+			}
+		}
 	}
 
-	// Calculate cutoff time
-	cutoff := time.Now().Add(-retention)
-	logger.Printf("Retention period: %s (removing files before %s)", dirConfig.RetentionPeriod, cutoff.Format(time.RFC3339))
+	return nil
+}
 
-	// Prepare to walk directory
-	walkFn := func(path string, info os.FileInfo, err error) error {
+// protectedPathList returns the absolute paths of general.protected_paths,
+// with glob patterns expanded and symbolic links also resolved
+func protectedPathList(config Config) ([]string, error) {
+	var protected []string
+	for _, path := range config.General.ProtectedPaths {
+		expanded, err := ExpandPath(path)
 		if err != nil {
-			logger.Printf("Error accessing path %s: %v", path, err)
-			return nil // Continue walking
+			return nil, fmt.Errorf("general.protected_paths: %v", err)
 		}
-
-		// Skip the root directory itself
-		if path == dirConfig.Path {
-			return nil
+		matches := []string{expanded}
+		if strings.ContainsAny(expanded, "*?[") {
+			if matches, err = filepath.Glob(expanded); err != nil {
+				return nil, fmt.Errorf("general.protected_paths: invalid pattern '%s': %v", expanded, err)
+			}
 		}
-
-		// Skip directories if we're not removing empty ones or if we're excluding subdirectories
-		if info.IsDir() {
-			if dirConfig.ExcludeSubdirs && path != dirConfig.Path {
-				return filepath.SkipDir
+		for _, match := range matches {
+			if abs, err := filepath.Abs(match); err == nil {
+				match = abs
+			}
+			protected = append(protected, filepath.Clean(match))
+			if resolved, err := filepath.EvalSymlinks(match); err == nil {
+				protected = append(protected, resolved)
 			}
-			// We'll handle directories in a second pass
-			return nil
 		}
+	}
+	return protected, nil
+}
 
-		// Check if the file matches the pattern
-		if dirConfig.FilePattern != "" {
-			match, err := filepath.Match(dirConfig.FilePattern, filepath.Base(path))
-			if err != nil {
-				logger.Printf("Error matching pattern '%s' for file %s: %v", dirConfig.FilePattern, path, err)
-				return nil
+// protectedPath describes why path may not be processed, or returns "" if it may
+func protectedPath(path string, protected []string) string {
+	// Relative paths are matched by where they point, such as ../../etc
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	candidates := []string{filepath.Clean(abs)}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil && resolved != candidates[0] {
+		candidates = append(candidates, resolved)
+	}
+	home, _ := os.UserHomeDir()
+
+	for _, candidate := range candidates {
+		name := path
+		if candidate != filepath.Clean(path) {
+			name = fmt.Sprintf("%s (resolves to %s)", path, candidate)
+		}
+		for _, pattern := range builtinProtectedPaths {
+			if match, _ := filepath.Match(pattern, candidate); match {
+				return fmt.Sprintf("%s is a protected system directory", name)
 			}
-			if !match {
-				return nil // Skip files that don't match the pattern
+		}
+		if home != "" && candidate == filepath.Clean(home) {
+			return fmt.Sprintf("%s is the home directory", name)
+		}
+		for _, other := range protected {
+			if pathsOverlap(candidate, other) {
+				return fmt.Sprintf("%s overlaps protected path %s", name, other)
 			}
 		}
+	}
 
-		// Check if the file is older than the cutoff
-		if info.ModTime().Before(cutoff) {
-			if securityConfig.DryRun {
-				logger.Printf("Would delete file: %s (modified: %s)", path, info.ModTime().Format(time.RFC3339))
-				fmt.Printf("Would delete file: %s (modified: %s)\n", path, info.ModTime().Format(time.RFC3339))
-			} else {
-				originalPath := path
+	return ""
+}
 
-				// Obfuscate filename if enabled (regardless of secure delete setting)
-				if securityConfig.SecureDelete.ObfuscateFilenames {
-					randomName, err := obfuscateFilename(path, logger)
-					if err != nil {
-						logger.Printf("Error obfuscating filename %s: %v", path, err)
-					} else {
-						path = randomName
-						logger.Printf("Obfuscated filename to: %s", path)
-					}
-				}
+// protectedKey is the context key of the protected paths of a run, as
+// returned by protectedPathList when the run started
+type protectedKey struct{}
 
-				// Perform the actual deletion (secure or regular)
-				if securityConfig.SecureDelete.Enabled {
-					if err := secureDeleteFile(path, securityConfig.SecureDelete.Passes, logger); err != nil {
-						logger.Printf("Error securely deleting file %s: %v", originalPath, err)
-					} else {
-						logger.Printf("Securely deleted file: %s", originalPath)
-					}
-				} else {
-					if err := os.Remove(path); err != nil {
-						logger.Printf("Error deleting file %s: %v", originalPath, err)
-					} else {
-						logger.Printf("Deleted file: %s", originalPath)
-					}
-				}
+// ExpandPath expands a leading ~ or ~user and $VAR, ${VAR} and ${VAR:-default}
+// references in a path. Undefined variables without a default are an error.
+func ExpandPath(path string) (string, error) {
+	var undefined []string
+	expanded := os.Expand(path, func(name string) string {
+		if i := strings.Index(name, ":-"); i >= 0 {
+			if value := os.Getenv(name[:i]); value != "" {
+				return value
 			}
+			return name[i+2:]
 		}
-
-		return nil
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return value
+	})
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("undefined variable %s in path %s", strings.Join(undefined, ", "), path)
 	}
 
-	// Walk the directory
-	if err := filepath.Walk(dirConfig.Path, walkFn); err != nil {
-		return err
+	if !strings.HasPrefix(expanded, "~") {
+		return expanded, nil
 	}
 
-	// Second pass: remove empty directories if configured
-	if dirConfig.RemoveEmptyDirs {
-		logger.Printf("Checking for empty directories in %s", dirConfig.Path)
+	// Split "~user/rest" into the user name and the rest of the path
+	name, rest := expanded[1:], ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
 
-		// We need to walk from the deepest directories first
-		var dirs []string
-		walkDirsFn := func(path string, info os.FileInfo, err error) error {
+	var homeDir string
+	if name == "" {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		homeDir = dir
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", fmt.Errorf("unknown user in path %s: %v", path, err)
+		}
+		homeDir = u.HomeDir
+	}
+
+	return homeDir + rest, nil
+}
+
+// Configuration file formats
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// configExtensions are the recognised configuration file extensions, in the
+// order they are looked for
+var configExtensions = []string{".yaml", ".yml", ".json", ".toml"}
+
+// configFormat returns the format of a configuration file based on its
+// extension. Files with other extensions are read as YAML.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatYAML
+	}
+}
+
+// decodeConfigData decodes configuration data into generic settings according
+// to the format of the file it was read from, upgrading older layouts. It
+// returns a warning for every migration applied.
+func decodeConfigData(path string, data []byte) (map[string]interface{}, []string, error) {
+	doc, err := parseConfigNode(path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	warnings, err := migrateConfigNode(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := doc.Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	if raw == nil {
+		raw = make(map[string]interface{})
+	}
+	return normalizeValue(raw).(map[string]interface{}), warnings, nil
+}
+
+// parseConfigNode parses configuration data into the mapping node of a YAML
+// document. JSON is parsed as YAML; TOML is converted.
+func parseConfigNode(path string, data []byte) (*yaml.Node, error) {
+	if configFormat(path) == FormatTOML {
+		var raw map[string]interface{}
+		if err := toml.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+		converted, err := yaml.Marshal(normalizeValue(raw))
+		if err != nil {
+			return nil, err
+		}
+		data = converted
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	// An empty file is an empty mapping
+	if len(root.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("configuration must be a mapping")
+	}
+	return doc, nil
+}
+
+// CurrentConfigVersion is the configuration schema version written by this program
+var CurrentConfigVersion = len(configMigrations)
+
+// configMigration upgrades a configuration layout by one version
+type configMigration struct {
+	description string
+	apply       func(doc *yaml.Node) error
+}
+
+// configMigrations[i] upgrades a configuration from version i to i+1.
+// Version 0 is a configuration without a version field.
+var configMigrations = []configMigration{
+	{
+		description: "add the version field (layout unchanged)",
+	},
+}
+
+// configVersion returns the schema version of a configuration document
+func configVersion(doc *yaml.Node) (int, error) {
+	version := 0
+	if _, value := mappingValue(doc, "version"); value != nil {
+		v, err := strconv.Atoi(value.Value)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid configuration version '%s'", value.Value)
+		}
+		version = v
+	}
+
+	if version > CurrentConfigVersion {
+		return 0, fmt.Errorf("configuration version %d is newer than supported version %d, please upgrade %s", version, CurrentConfigVersion, ProgramName)
+	}
+	return version, nil
+}
+
+// migrationSteps describes the migrations from a version to the current one
+func migrationSteps(version int) []string {
+	var steps []string
+	for ; version < CurrentConfigVersion; version++ {
+		steps = append(steps, fmt.Sprintf("configuration migrated from version %d to %d: %s", version, version+1, configMigrations[version].description))
+	}
+	return steps
+}
+
+// migrateConfigNode upgrades a configuration document to the current schema
+// version in place and returns a warning for every step that changed the
+// layout; steps that only add the version field are not worth a warning
+func migrateConfigNode(doc *yaml.Node) ([]string, error) {
+	version, err := configVersion(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	for ; version < CurrentConfigVersion; version++ {
+		migration := configMigrations[version]
+		if migration.apply == nil {
+			continue
+		}
+		if err := migration.apply(doc); err != nil {
+			return nil, fmt.Errorf("migrating configuration from version %d: %v", version, err)
+		}
+		warnings = append(warnings, migrationSteps(version)[0])
+	}
+
+	setConfigVersion(doc, CurrentConfigVersion)
+	return warnings, nil
+}
+
+// setConfigVersion sets the version field of a document, adding it as the first key if missing
+func setConfigVersion(doc *yaml.Node, version int) {
+	value := strconv.Itoa(version)
+	if _, node := mappingValue(doc, "version"); node != nil {
+		node.Value = value
+		node.Tag = "!!int"
+		node.Style = 0
+		return
+	}
+
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version", HeadComment: "Configuration schema version"}
+	val := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: value}
+
+	// Keep a comment at the top of the file above the new key
+	if len(doc.Content) > 0 && doc.Content[0].HeadComment != "" {
+		key.HeadComment = doc.Content[0].HeadComment + "\n\n# " + key.HeadComment
+		doc.Content[0].HeadComment = ""
+	}
+	doc.Content = append([]*yaml.Node{key, val}, doc.Content...)
+}
+
+// normalizeValue converts typed slices produced by the decoders into the
+// generic []interface{} used when merging
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeValue(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeValue(item)
+		}
+		return v
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = normalizeValue(item)
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+// findConfigFile returns the configuration file to use for a path: the path
+// itself if it exists, otherwise the first existing file with the same name
+// and another supported extension
+func findConfigFile(path string) string {
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, ext := range configExtensions {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext
+		}
+	}
+	return path
+}
+
+// isDefaultConfig reports whether path is the default configuration file in any format
+func isDefaultConfig(path string) bool {
+	if configFile == "" {
+		return false
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path)) == strings.TrimSuffix(configFile, filepath.Ext(configFile))
+}
+
+// loadConfigFiles reads and merges a configuration file, its includes and,
+// for the default configuration file, the drop-in directory
+func loadConfigFiles(configPath string) (*configLoader, error) {
+	loader := newConfigLoader()
+	if err := loader.load(configPath); err != nil {
+		return loader, err
+	}
+
+	// Drop-in files belong to the default configuration only
+	if isDefaultConfig(configPath) && dropInDir != "" {
+		var dropIns []string
+		for _, ext := range configExtensions {
+			matches, err := filepath.Glob(filepath.Join(dropInDir, "*"+ext))
 			if err != nil {
-				return nil // Continue walking
+				return loader, err
+			}
+			dropIns = append(dropIns, matches...)
+		}
+		sort.Strings(dropIns)
+		for _, dropIn := range dropIns {
+			if err := loader.load(dropIn); err != nil {
+				return loader, err
+			}
+		}
+	}
+
+	return loader, nil
+}
+
+// configLoader merges several configuration files into one
+type configLoader struct {
+	merged   map[string]interface{}
+	origins  map[string]string // file that set each scalar setting
+	loading  map[string]bool   // files being loaded, to detect include cycles
+	files    []string          // files read so far, in load order
+	warnings []string          // migrations applied to older files
+}
+
+// newConfigLoader creates an empty configuration loader
+func newConfigLoader() *configLoader {
+	return &configLoader{
+		merged:  make(map[string]interface{}),
+		origins: make(map[string]string),
+		loading: make(map[string]bool),
+	}
+}
+
+// load reads a configuration file and merges it, followed by its includes
+func (l *configLoader) load(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if l.loading[absPath] {
+		return fmt.Errorf("include cycle detected at %s", path)
+	}
+	l.loading[absPath] = true
+	defer delete(l.loading, absPath)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	l.files = append(l.files, path)
+
+	raw, warnings, err := decodeConfigData(path, data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, warning := range warnings {
+		l.warnings = append(l.warnings, fmt.Sprintf("%s: %s", path, warning))
+	}
+
+	// Includes are resolved relative to the including file
+	var includes []string
+	if value, ok := raw["include"]; ok {
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: include must be a list of paths", path)
+		}
+		for _, item := range list {
+			include, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("%s: include must be a list of paths", path)
+			}
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(path), include)
+			}
+			includes = append(includes, include)
+		}
+		delete(raw, "include")
+	}
+
+	if err := l.merge(l.merged, raw, "", path); err != nil {
+		return err
+	}
+
+	for _, include := range includes {
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			return fmt.Errorf("%s: invalid include pattern '%s': %v", path, include, err)
+		}
+		if matches == nil && !strings.ContainsAny(include, "*?[") {
+			return fmt.Errorf("%s: included file does not exist: %s", path, include)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if err := l.load(match); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// merge merges src into dst: mappings are merged key by key, lists are
+// concatenated and scalars must not be set to different values by two files
+func (l *configLoader) merge(dst, src map[string]interface{}, prefix, source string) error {
+	keys := make([]string, 0, len(src))
+	for key := range src {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := src[key]
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = value
+			l.recordOrigins(name, value, source)
+			continue
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if e, ok := existing.(map[string]interface{}); ok {
+				if err := l.merge(e, v, name, source); err != nil {
+					return err
+				}
+				continue
+			}
+		case []interface{}:
+			if e, ok := existing.([]interface{}); ok {
+				dst[key] = append(e, v...)
+				continue
+			}
+		}
+
+		if reflect.DeepEqual(existing, value) {
+			continue
+		}
+		return fmt.Errorf("conflicting values for %s: %v in %s, %v in %s", name, existing, l.origins[name], value, source)
+	}
+
+	return nil
+}
+
+// recordOrigins remembers which file set a value and everything below it
+func (l *configLoader) recordOrigins(name string, value interface{}, source string) {
+	l.origins[name] = source
+	if m, ok := value.(map[string]interface{}); ok {
+		for key, v := range m {
+			l.recordOrigins(name+"."+key, v, source)
+		}
+	}
+}
+
+// decode converts the merged settings into a Config, applying the named profile
+func (l *configLoader) decode(profile string) (Config, error) {
+	raw := copyValue(l.merged).(map[string]interface{})
+	if err := applyProfile(raw, profile); err != nil {
+		return Config{}, err
+	}
+	applyDirectoryDefaults(raw)
+
+	data, err := yaml.Marshal(raw)
+	if err != nil {
+		return Config{}, err
+	}
+
+	config := Config{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return Config{}, err
+	}
+
+	// Defaults and the selected profile have been applied to the settings
+	config.Defaults = DirectoryConfig{}
+	config.Profiles = nil
+	config.Warnings = l.warnings
+
+	return config, nil
+}
+
+// profileNames returns the names of the profiles in the merged settings
+func profileNames(raw map[string]interface{}) []string {
+	profiles, _ := raw["profiles"].(map[string]interface{})
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile replaces the directories and overrides the security settings
+// with those of the named profile
+func applyProfile(raw map[string]interface{}, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	profiles, _ := raw["profiles"].(map[string]interface{})
+	profile, ok := profiles[name].(map[string]interface{})
+	if !ok {
+		if _, exists := profiles[name]; exists {
+			return fmt.Errorf("profile %s must be a mapping", name)
+		}
+		available := "none"
+		if names := profileNames(raw); len(names) > 0 {
+			available = strings.Join(names, ", ")
+		}
+		return fmt.Errorf("unknown profile '%s' (available: %s)", name, available)
+	}
+
+	if dirs, ok := profile["directories"]; ok {
+		raw["directories"] = dirs
+	}
+	if override, ok := profile["security"].(map[string]interface{}); ok {
+		security, _ := raw["security"].(map[string]interface{})
+		fillMissing(override, security)
+		raw["security"] = override
+	}
+
+	return nil
+}
+
+// applyDirectoryDefaults copies settings from the defaults section into every
+// directory entry that doesn't set them itself
+func applyDirectoryDefaults(raw map[string]interface{}) {
+	defaults, _ := raw["defaults"].(map[string]interface{})
+	security, _ := raw["security"].(map[string]interface{})
+
+	dirs, _ := raw["directories"].([]interface{})
+	for _, dir := range dirs {
+		entry, ok := dir.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fillMissing(entry, defaults)
+
+		// A security block only overrides the global settings it names
+		if override, ok := entry["security"].(map[string]interface{}); ok {
+			fillMissing(override, security)
+		}
+	}
+}
+
+// fillMissing copies keys from src that are missing in dst, descending into
+// mappings present in both
+func fillMissing(dst, src map[string]interface{}) {
+	for key, value := range src {
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = copyValue(value)
+			continue
+		}
+		if e, ok := existing.(map[string]interface{}); ok {
+			if v, ok := value.(map[string]interface{}); ok {
+				fillMissing(e, v)
+			}
+		}
+	}
+}
+
+// copyValue returns a deep copy of a decoded configuration value
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = copyValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = copyValue(item)
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+// PrintEffectiveConfig prints the configuration after includes and defaults have been applied
+func PrintEffectiveConfig(config Config) error {
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	return nil
+}
+
+// Valid logging levels
+var loggingLevels = []string{"debug", "info", "warn", "error"}
+
+// parseLoggingLevel returns a logging level in lower case, the form used by
+// both validation and the logger. Levels are case-insensitive and default to info.
+func parseLoggingLevel(level string) (string, error) {
+	if level == "" {
+		return "info", nil
+	}
+	normalized := strings.ToLower(strings.TrimSpace(level))
+	if !containsString(loggingLevels, normalized) {
+		return "", fmt.Errorf("invalid logging level '%s' (expected %s)", level, strings.Join(loggingLevels, ", "))
+	}
+	return normalized, nil
+}
+
+// accessReadWriteExec is the access(2) mode needed to delete files in a directory
+const accessReadWriteExec = 0x4 | 0x2 | 0x1
+
+// ConfigProblem is a problem found while validating a configuration file
+type ConfigProblem struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+// String formats the problem as file:line:column: message
+func (p ConfigProblem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+}
+
+// ValidateConfig strictly checks a configuration file and everything it
+// includes, returning every problem found
+func ValidateConfig(configPath string) []ConfigProblem {
+	var problems []ConfigProblem
+
+	loader, loadErr := loadConfigFiles(configPath)
+	for _, file := range loader.files {
+		problems = append(problems, validateConfigFile(file)...)
+	}
+
+	var config Config
+	if loadErr == nil {
+		config, loadErr = LoadConfig(configPath)
+	}
+
+	// Problems loading the merged configuration, such as conflicting settings
+	// or missing includes, are only reported if the files themselves are fine
+	if loadErr != nil {
+		if len(problems) == 0 {
+			problems = append(problems, ConfigProblem{File: configPath, Message: loadErr.Error()})
+		}
+		return problems
+	}
+
+	// Required settings may come from defaults, so they are checked on the
+	// result, both without a profile and for every profile
+	problems = append(problems, checkRequiredSettings(configPath, "", config)...)
+	for _, profile := range profileNames(loader.merged) {
+		profileConfig, err := loader.decode(profile)
+		if err != nil {
+			problems = append(problems, ConfigProblem{File: configPath, Message: err.Error()})
+			continue
+		}
+		problems = append(problems, checkRequiredSettings(configPath, profile, profileConfig)...)
+		if err := expandConfigPaths(&profileConfig); err == nil {
+			if err := checkProtectedPaths(profileConfig); err != nil {
+				problems = append(problems, ConfigProblem{File: configPath, Message: fmt.Sprintf("profile %s: %v", profile, err)})
+			}
+		}
+	}
+
+	return problems
+}
+
+// checkRequiredSettings checks that every directory entry of a loaded
+// configuration has a path and a retention period
+func checkRequiredSettings(configPath, profile string, config Config) []ConfigProblem {
+	prefix := ""
+	if profile != "" {
+		prefix = "profile " + profile + ": "
+	}
+
+	var problems []ConfigProblem
+	for i, dir := range config.Directories {
+		if dir.Path == "" {
+			problems = append(problems, ConfigProblem{File: configPath, Message: fmt.Sprintf("%sdirectories[%d] has no path", prefix, i)})
+		}
+		if dir.RetentionPeriod == "" {
+			problems = append(problems, ConfigProblem{File: configPath, Message: fmt.Sprintf("%sdirectories[%d] (%s) has no retention_period", prefix, i, dir.Path)})
+		}
+	}
+	return problems
+}
+
+// yamlErrorLine matches the line number in yaml error messages
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// validateConfigFile checks a single configuration file. JSON is checked by
+// the YAML parser directly; TOML is converted first and reported without positions.
+func validateConfigFile(path string) []ConfigProblem {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []ConfigProblem{{File: path, Message: err.Error()}}
+	}
+
+	if configFormat(path) == FormatTOML {
+		doc, err := parseConfigNode(path, data)
+		if err != nil {
+			return []ConfigProblem{{File: path, Message: err.Error()}}
+		}
+		if data, err = yaml.Marshal(doc); err != nil {
+			return []ConfigProblem{{File: path, Message: err.Error()}}
+		}
+		problems := validateConfigData(path, data)
+		for i := range problems {
+			problems[i].Line, problems[i].Column = 0, 0
+		}
+		return problems
+	}
+
+	return validateConfigData(path, data)
+}
+
+// problemAt returns a problem in file at the position of node, if any
+func problemAt(file string, node *yaml.Node, format string, args ...interface{}) ConfigProblem {
+	problem := ConfigProblem{File: file, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		problem.Line, problem.Column = node.Line, node.Column
+	}
+	return problem
+}
+
+// validateConfigData checks the YAML (or JSON) content of a configuration file
+func validateConfigData(path string, data []byte) []ConfigProblem {
+	var problems []ConfigProblem
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		problems = append(problems, yamlProblem(path, err.Error(), nil))
+		return problems
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+
+	// Strict decoding reports unknown fields and type mismatches
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var config Config
+	if err := decoder.Decode(&config); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			for _, msg := range typeErr.Errors {
+				problems = append(problems, yamlProblem(path, msg, doc))
+			}
+		} else {
+			problems = append(problems, yamlProblem(path, err.Error(), doc))
+		}
+	}
+
+	// Schema version
+	if _, version := mappingValue(doc, "version"); version != nil {
+		if v, err := strconv.Atoi(version.Value); err != nil || v < 0 {
+			problems = append(problems, problemAt(path, version, "invalid configuration version '%s'", version.Value))
+		} else if v > CurrentConfigVersion {
+			problems = append(problems, problemAt(path, version, "configuration version %d is newer than supported version %d", v, CurrentConfigVersion))
+		}
+	}
+
+	// General settings
+	_, general := mappingValue(doc, "general")
+	if _, workers := mappingValue(general, "workers"); workers != nil {
+		if n, err := strconv.Atoi(workers.Value); err == nil && n < 0 {
+			problems = append(problems, problemAt(path, workers, "workers must not be negative"))
+		}
+	}
+	problems = append(problems, validateLimitsNode(path, general)...)
+	_, logging := mappingValue(general, "logging")
+	if _, level := mappingValue(logging, "level"); level != nil {
+		if _, err := parseLoggingLevel(level.Value); err != nil {
+			problems = append(problems, problemAt(path, level, "%v", err))
+		}
+	}
+	if _, file := mappingValue(logging, "file"); file != nil {
+		if _, err := ExpandPath(file.Value); err != nil {
+			problems = append(problems, problemAt(path, file, "invalid log file: %v", err))
+		}
+	}
+
+	// Security settings
+	_, security := mappingValue(doc, "security")
+	problems = append(problems, validateSecurityNode(path, security)...)
+
+	// Profiles
+	if _, profiles := mappingValue(doc, "profiles"); profiles != nil && profiles.Kind == yaml.MappingNode {
+		for i := 1; i < len(profiles.Content); i += 2 {
+			profile := profiles.Content[i]
+			_, security := mappingValue(profile, "security")
+			problems = append(problems, validateSecurityNode(path, security)...)
+			if _, dirs := mappingValue(profile, "directories"); dirs != nil && dirs.Kind == yaml.SequenceNode {
+				for _, entry := range dirs.Content {
+					problems = append(problems, validateDirectoryNode(path, entry)...)
+				}
+			}
+		}
+	}
+
+	// Defaults for directory entries
+	if _, defaults := mappingValue(doc, "defaults"); defaults != nil {
+		if key, _ := mappingValue(defaults, "path"); key != nil {
+			problems = append(problems, problemAt(path, key, "path cannot be set in defaults"))
+		}
+		problems = append(problems, validateDirectoryNode(path, defaults)...)
+	}
+
+	// Directory entries
+	if _, dirs := mappingValue(doc, "directories"); dirs != nil && dirs.Kind == yaml.SequenceNode {
+		for _, entry := range dirs.Content {
+			problems = append(problems, validateDirectoryNode(path, entry)...)
+		}
+	}
+
+	// Report problems in file order
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Column < problems[j].Column
+	})
+
+	return problems
+}
+
+// validateSecurityNode checks a security section
+func validateSecurityNode(path string, security *yaml.Node) []ConfigProblem {
+	var problems []ConfigProblem
+
+	_, secureDelete := mappingValue(security, "secure_delete")
+	if _, passes := mappingValue(secureDelete, "passes"); passes != nil {
+		if n, err := strconv.Atoi(passes.Value); err == nil && n < 0 {
+			problems = append(problems, problemAt(path, passes, "passes must not be negative"))
+		}
+	}
+	if _, workers := mappingValue(secureDelete, "workers"); workers != nil {
+		if n, err := strconv.Atoi(workers.Value); err == nil && n < 0 {
+			problems = append(problems, problemAt(path, workers, "workers must not be negative"))
+		}
+	}
+	if _, policy := mappingValue(secureDelete, "hardlink_policy"); policy != nil {
+		switch policy.Value {
+		case "", HardlinkPolicySkip, HardlinkPolicyUnlink, HardlinkPolicyShred:
+		default:
+			problems = append(problems, problemAt(path, policy, "invalid hardlink policy '%s' (expected skip, unlink or shred)", policy.Value))
+		}
+	}
+	if _, rate := mappingValue(secureDelete, "max_bytes_per_second"); rate != nil {
+		if _, err := ParseSize(rate.Value); err != nil {
+			problems = append(problems, problemAt(path, rate, "invalid max_bytes_per_second '%s': %v", rate.Value, err))
+		}
+	}
+
+	return problems
+}
+
+// validateDirectoryNode checks a single directory entry
+func validateDirectoryNode(path string, entry *yaml.Node) []ConfigProblem {
+	var problems []ConfigProblem
+
+	if entry.Kind != yaml.MappingNode {
+		problems = append(problems, problemAt(path, entry, "directory entry must be a mapping"))
+		return problems
+	}
+
+	// Path must exist and be a directory we can delete from
+	if _, dirPath := mappingValue(entry, "path"); dirPath == nil {
+		// Checked on the merged configuration
+	} else if dirPath.Value == "" {
+		problems = append(problems, problemAt(path, dirPath, "directory path is empty"))
+	} else if expanded, err := ExpandPath(dirPath.Value); err != nil {
+		problems = append(problems, problemAt(path, dirPath, "invalid path: %v", err))
+	} else if strings.ContainsAny(expanded, "*?[") {
+		if _, err := filepath.Glob(expanded); err != nil {
+			problems = append(problems, problemAt(path, dirPath, "invalid path pattern '%s': %v", expanded, err))
+		}
+	} else if info, err := os.Stat(expanded); err != nil {
+		problems = append(problems, problemAt(path, dirPath, "directory %s is not accessible: %v", expanded, err))
+	} else if !info.IsDir() {
+		problems = append(problems, problemAt(path, dirPath, "%s is not a directory", expanded))
+	} else if err := syscall.Access(expanded, accessReadWriteExec); err != nil {
+		problems = append(problems, problemAt(path, dirPath, "insufficient permissions on %s: %v", expanded, err))
+	}
+
+	if _, retention := mappingValue(entry, "retention_period"); retention == nil {
+		// Checked on the merged configuration
+	} else if _, err := ParseDuration(retention.Value); err != nil {
+		problems = append(problems, problemAt(path, retention, "invalid retention period '%s': %v", retention.Value, err))
+	}
+
+	if _, pattern := mappingValue(entry, "file_pattern"); pattern != nil {
+		if _, err := filepath.Match(pattern.Value, ""); err != nil {
+			problems = append(problems, problemAt(path, pattern, "invalid file pattern '%s': %v", pattern.Value, err))
+		}
+	}
+
+	if _, schedule := mappingValue(entry, "schedule"); schedule != nil {
+		if _, err := ParseSchedule(schedule.Value); err != nil {
+			problems = append(problems, problemAt(path, schedule, "invalid schedule: %v", err))
+		}
+	}
+
+	if _, period := mappingValue(entry, "quarantine_period"); period != nil {
+		if _, err := ParseDuration(period.Value); err != nil {
+			problems = append(problems, problemAt(path, period, "invalid quarantine period '%s': %v", period.Value, err))
+		}
+	}
+
+	problems = append(problems, validateLimitsNode(path, entry)...)
+
+	if _, percent := mappingValue(entry, "mass_delete_percent"); percent != nil {
+		if n, err := strconv.Atoi(percent.Value); err == nil && (n < 0 || n > 100) {
+			problems = append(problems, problemAt(path, percent, "mass_delete_percent must be between 0 and 100"))
+		}
+	}
+	if _, minFiles := mappingValue(entry, "mass_delete_min_files"); minFiles != nil {
+		if n, err := strconv.Atoi(minFiles.Value); err == nil && n < 0 {
+			problems = append(problems, problemAt(path, minFiles, "mass_delete_min_files must not be negative"))
+		}
+	}
+
+	_, security := mappingValue(entry, "security")
+	problems = append(problems, validateSecurityNode(path, security)...)
+
+	return problems
+}
+
+// validateLimitsNode checks the run limits of a general section or directory entry
+func validateLimitsNode(path string, node *yaml.Node) []ConfigProblem {
+	var problems []ConfigProblem
+
+	if _, runtime := mappingValue(node, "max_runtime"); runtime != nil {
+		if _, err := ParseDuration(runtime.Value); err != nil {
+			problems = append(problems, problemAt(path, runtime, "invalid max_runtime '%s': %v", runtime.Value, err))
+		}
+	}
+	if _, deletions := mappingValue(node, "max_deletions"); deletions != nil {
+		if n, err := strconv.Atoi(deletions.Value); err == nil && n < 0 {
+			problems = append(problems, problemAt(path, deletions, "max_deletions must not be negative"))
+		}
+	}
+	if _, size := mappingValue(node, "max_bytes"); size != nil {
+		if _, err := ParseSize(size.Value); err != nil {
+			problems = append(problems, problemAt(path, size, "invalid max_bytes '%s': %v", size.Value, err))
+		}
+	}
+
+	return problems
+}
+
+// yamlProblem converts a yaml error message into a problem, looking up the
+// column of the offending key in doc where possible
+func yamlProblem(path, msg string, doc *yaml.Node) ConfigProblem {
+	m := yamlErrorLine.FindStringSubmatch(msg)
+	if m == nil {
+		return ConfigProblem{File: path, Message: strings.TrimPrefix(msg, "yaml: ")}
+	}
+
+	line, _ := strconv.Atoi(m[1])
+	problem := ConfigProblem{File: path, Line: line, Column: 1, Message: m[2]}
+
+	// Unknown fields are reported as "field NAME not found in type T"
+	var field string
+	if fields := strings.Fields(m[2]); len(fields) > 1 && fields[0] == "field" {
+		field = fields[1]
+		problem.Message = fmt.Sprintf("unknown field '%s'", field)
+	}
+	if node := findNodeOnLine(doc, line, field); node != nil {
+		problem.Column = node.Column
+	}
+
+	return problem
+}
+
+// findNodeOnLine returns the node with the given value on a line, or the
+// first node on that line if value is empty or not found
+func findNodeOnLine(node *yaml.Node, line int, value string) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+
+	var first *yaml.Node
+	var walk func(n *yaml.Node) *yaml.Node
+	walk = func(n *yaml.Node) *yaml.Node {
+		if n.Line == line && n.Kind == yaml.ScalarNode {
+			if value != "" && n.Value == value {
+				return n
+			}
+			if first == nil {
+				first = n
+			}
+		}
+		for _, child := range n.Content {
+			if found := walk(child); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+
+	if found := walk(node); found != nil {
+		return found
+	}
+	return first
+}
+
+// mappingValue returns the key and value nodes for key in a mapping node
+func mappingValue(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Patterns accepted by ParseDuration and ParseSize, for the JSON Schema
+const (
+	durationPattern = `^([0-9]+d|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+	sizePattern     = `^[0-9]+ *([kKmMgGtT]([iI]?[bB])?|[bB])?$`
+)
+
+// schemaEnums are the allowed values referenced by enum= schema tags
+var schemaEnums = map[string][]string{
+	"logging_level":   loggingLevels,
+	"hardlink_policy": {HardlinkPolicySkip, HardlinkPolicyUnlink, HardlinkPolicyShred},
+}
+
+// caseInsensitivePattern returns a regular expression matching any of values
+// in any case, as JSON Schema patterns have no case-insensitive flag
+func caseInsensitivePattern(values []string) string {
+	alternatives := make([]string, len(values))
+	for i, value := range values {
+		var b strings.Builder
+		for _, r := range value {
+			if lower, upper := strings.ToLower(string(r)), strings.ToUpper(string(r)); lower != upper {
+				b.WriteString("[" + lower + upper + "]")
+			} else {
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		alternatives[i] = b.String()
+	}
+	return "^(" + strings.Join(alternatives, "|") + ")$"
+}
+
+// ConfigSchema returns a JSON Schema describing the configuration file,
+// generated from the configuration structs
+func ConfigSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = ProgramName + " configuration"
+	return schema
+}
+
+// typeSchema returns the JSON Schema of a configuration type
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "-" || name == "" {
+				continue
+			}
+			properties[name] = fieldSchema(field)
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// fieldSchema returns the JSON Schema of a struct field, applying its schema tag
+func fieldSchema(field reflect.StructField) map[string]interface{} {
+	schema := typeSchema(field.Type)
+
+	for _, option := range strings.Split(field.Tag.Get("schema"), ",") {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "duration":
+			schema["pattern"] = durationPattern
+			schema["description"] = "Duration such as 30d, 24h or 60m"
+		case "size":
+			schema["pattern"] = sizePattern
+			schema["description"] = "Size in bytes or with a unit such as 64K, 50MB or 1GiB"
+		case "schedule":
+			schema["description"] = "Daemon schedule: a cron expression such as '0 3 * * *', @daily, or an interval such as 6h"
+		case "enum":
+			schema["enum"] = schemaEnums[value]
+		case "nocase":
+			// JSON Schema enums are case-sensitive, so match the values with a pattern
+			if values, ok := schema["enum"].([]string); ok {
+				delete(schema, "enum")
+				schema["pattern"] = caseInsensitivePattern(values)
+				schema["description"] = "One of " + strings.Join(values, ", ") + " (any case)"
+			}
+		case "min":
+			if min, err := strconv.Atoi(value); err == nil {
+				schema["minimum"] = min
+			}
+		case "max":
+			if max, err := strconv.Atoi(value); err == nil {
+				schema["maximum"] = max
+			}
+		}
+	}
+
+	return schema
+}
+
+// runConfigSchema implements the config schema command and returns the exit code
+func runConfigSchema(args []string) int {
+	flags := flag.NewFlagSet("config schema", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	data, err := json.MarshalIndent(ConfigSchema(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating schema: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(data))
+	return 0
+}
+
+// MigrateConfigFile rewrites a configuration file in the current schema
+// version. YAML comments and ordering are preserved; the original file is
+// kept with a .bak suffix. It returns the migrations applied, if any.
+func MigrateConfigFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	root, doc, err := readConfigDocument(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := configVersion(doc)
+	if err != nil || version == CurrentConfigVersion {
+		return nil, err
+	}
+	if _, err := migrateConfigNode(doc); err != nil {
+		return nil, err
+	}
+
+	encoded, err := encodeConfigDocument(path, root, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path+".bak", data, info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, encoded, info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+
+	return migrationSteps(version), nil
+}
+
+// readConfigDocument parses a configuration file for editing. It returns the
+// YAML document node (nil for TOML, which has no comments to keep) and the
+// mapping node of the configuration.
+func readConfigDocument(path string, data []byte) (*yaml.Node, *yaml.Node, error) {
+	if configFormat(path) == FormatTOML {
+		doc, err := parseConfigNode(path, data)
+		return nil, doc, err
+	}
+
+	// Parse the whole document so comments around the mapping are kept
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, err
+	}
+	if len(root.Content) == 0 {
+		doc := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{doc}}
+	}
+	if root.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("configuration must be a mapping")
+	}
+	return &root, root.Content[0], nil
+}
+
+// encodeConfigDocument encodes a configuration read by readConfigDocument in
+// the format of path
+func encodeConfigDocument(path string, root, doc *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	format := configFormat(path)
+	if format == FormatYAML {
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(root); err != nil {
+			return nil, err
+		}
+		encoder.Close()
+		return buf.Bytes(), nil
+	}
+
+	var raw map[string]interface{}
+	if err := doc.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if format == FormatJSON {
+		encoded, err := json.MarshalIndent(raw, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encoded)
+		buf.WriteString("\n")
+	} else if err := toml.NewEncoder(&buf).Encode(raw); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EditConfigFile applies edit to the configuration mapping of a file and
+// writes the result atomically. YAML comments and ordering are preserved.
+// The file is left unchanged if the edit introduces validation problems;
+// those problems are returned.
+func EditConfigFile(path string, edit func(doc *yaml.Node) error) ([]ConfigProblem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	root, doc, err := readConfigDocument(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Problems already in the file don't block an edit
+	existing := make(map[string]int)
+	for _, problem := range validateConfigFile(path) {
+		existing[problem.Message]++
+	}
+
+	if err := edit(doc); err != nil {
+		return nil, err
+	}
+
+	encoded, err := encodeConfigDocument(path, root, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the result, with positions for YAML and JSON only
+	check := encoded
+	if root == nil {
+		if check, err = yaml.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	var problems []ConfigProblem
+	for _, problem := range validateConfigData(path, check) {
+		if existing[problem.Message] > 0 {
+			existing[problem.Message]--
+			continue
+		}
+		if root == nil {
+			problem.Line, problem.Column = 0, 0
+		}
+		problems = append(problems, problem)
+	}
+	if len(problems) > 0 {
+		return problems, nil
+	}
+
+	return nil, writeFileAtomic(path, encoded, info.Mode().Perm())
+}
+
+// writeFileAtomic replaces a file by writing a temporary file next to it and renaming it
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// runConfig implements the config command and returns the exit code
+func runConfig(args []string) int {
+	usage := "Usage: filekeeper config migrate [--config PATH] | filekeeper config schema"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "migrate":
+		return runConfigMigrate(args[1:])
+	case "schema":
+		return runConfigSchema(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown config command: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
+
+// runConfigMigrate implements the config migrate command and returns the exit code
+func runConfigMigrate(args []string) int {
+	flags := flag.NewFlagSet("config migrate", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "Configuration file to migrate")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path := *configPath
+	if path == configFile {
+		path = findConfigFile(path)
+	}
+
+	// Includes and drop-in files are migrated along with the main file
+	loader, err := loadConfigFiles(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration %s: %v\n", path, err)
+		return 1
+	}
+
+	status := 0
+	for _, file := range loader.files {
+		warnings, err := MigrateConfigFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error migrating configuration %s: %v\n", file, err)
+			status = 1
+			continue
+		}
+		if len(warnings) == 0 {
+			fmt.Printf("Configuration %s is already at version %d\n", file, CurrentConfigVersion)
+			continue
+		}
+
+		for _, warning := range warnings {
+			fmt.Printf("%s: %s\n", file, warning)
+		}
+		fmt.Printf("Configuration %s migrated to version %d (original saved as %s.bak)\n", file, CurrentConfigVersion, file)
+	}
+	return status
+}
+
+// runValidate implements the validate command and returns the exit code
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "Configuration file to validate")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path := *configPath
+	if path == configFile {
+		path = findConfigFile(path)
+	}
+
+	problems := ValidateConfig(path)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found in configuration %s\n", len(problems), path)
+		return 1
+	}
+
+	fmt.Printf("Configuration %s is valid\n", path)
+	return 0
+}
+
+// directorySettings returns the scalar settings of a directory entry that
+// the dir commands can change, with the kind of value each one takes
+func directorySettings() map[string]reflect.Kind {
+	settings := make(map[string]reflect.Kind)
+	t := reflect.TypeOf(DirectoryConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		switch field.Type.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int:
+			settings[name] = field.Type.Kind()
+		}
+	}
+	return settings
+}
+
+// directoryEntries returns the directories sequence of a configuration
+// mapping, creating it if create is set
+func directoryEntries(doc *yaml.Node, create bool) *yaml.Node {
+	if _, dirs := mappingValue(doc, "directories"); dirs != nil && dirs.Kind == yaml.SequenceNode {
+		return dirs
+	} else if dirs != nil && create {
+		*dirs = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		return dirs
+	}
+	if !create {
+		return nil
+	}
+	dirs := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "directories"}, dirs)
+	return dirs
+}
+
+// findDirectoryEntry returns the index of the entry for path in a directories
+// sequence, or -1. Paths match as written or after expansion.
+func findDirectoryEntry(dirs *yaml.Node, path string) int {
+	if dirs == nil {
+		return -1
+	}
+	expanded, err := ExpandPath(path)
+	if err != nil {
+		expanded = path
+	}
+	for i, entry := range dirs.Content {
+		_, value := mappingValue(entry, "path")
+		if value == nil {
+			continue
+		}
+		if value.Value == path {
+			return i
+		}
+		if other, err := ExpandPath(value.Value); err == nil && filepath.Clean(other) == filepath.Clean(expanded) {
+			return i
+		}
+	}
+	return -1
+}
+
+// setDirectorySetting sets a scalar setting of a directory entry node,
+// keeping the position and quoting of an existing value
+func setDirectorySetting(entry *yaml.Node, key, value string) error {
+	kind, ok := directorySettings()[key]
+	if !ok {
+		var names []string
+		for name := range directorySettings() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown directory setting '%s' (expected one of %s)", key, strings.Join(names, ", "))
+	}
+
+	node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value, Style: yaml.DoubleQuotedStyle}
+	switch kind {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for %s: expected true or false", value, key)
+		}
+		node = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(b)}
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for %s: expected a number", value, key)
+		}
+		node = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(n)}
+	}
+
+	if _, existing := mappingValue(entry, key); existing != nil {
+		if existing.Kind == yaml.ScalarNode && kind == reflect.String && existing.Style != 0 {
+			node.Style = existing.Style
+		}
+		node.HeadComment, node.LineComment, node.FootComment = existing.HeadComment, existing.LineComment, existing.FootComment
+		*existing = *node
+		return nil
+	}
+	entry.Content = append(entry.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, node)
+	return nil
+}
+
+// runDir implements the dir command and returns the exit code
+func runDir(args []string) int {
+	usage := "Usage: filekeeper dir list|add|remove|set [--config PATH] ..."
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "list":
+		return runDirList(args[1:])
+	case "add":
+		return runDirAdd(args[1:])
+	case "remove":
+		return runDirRemove(args[1:])
+	case "set":
+		return runDirSet(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown dir command: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
+
+// parseInterspersed parses flags that may appear before, between or after
+// positional arguments and returns the positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// editDirectories applies a change to the configuration file and reports the
+// outcome; it returns the exit code
+func editDirectories(path, done string, edit func(doc *yaml.Node) error) int {
+	problems, err := EditConfigFile(path, edit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating configuration %s: %v\n", path, err)
+		return 1
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		fmt.Fprintf(os.Stderr, "Configuration %s not changed: %d problem(s) found\n", path, len(problems))
+		return 1
+	}
+
+	fmt.Println(done)
+	return 0
+}
+
+// runDirList implements the dir list command and returns the exit code
+func runDirList(args []string) int {
+	flags := flag.NewFlagSet("dir list", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "Configuration file to read")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path := *configPath
+	if path == configFile {
+		path = findConfigFile(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration %s: %v\n", path, err)
+		return 1
+	}
+	_, doc, err := readConfigDocument(path, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration %s: %v\n", path, err)
+		return 1
+	}
+
+	dirs := directoryEntries(doc, false)
+	if dirs == nil || len(dirs.Content) == 0 {
+		fmt.Printf("No directories in configuration %s\n", path)
+		return 0
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, entry := range dirs.Content {
+		dirPath := "(no path)"
+		var settings []string
+		for i := 0; i+1 < len(entry.Content); i += 2 {
+			key, value := entry.Content[i].Value, entry.Content[i+1]
+			switch {
+			case key == "path":
+				dirPath = value.Value
+			case value.Kind == yaml.ScalarNode:
+				settings = append(settings, key+"="+value.Value)
+			default:
+				settings = append(settings, key+"=(custom)")
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%s\n", dirPath, strings.Join(settings, " "))
+	}
+	writer.Flush()
+	return 0
+}
+
+// runDirAdd implements the dir add command and returns the exit code
+func runDirAdd(args []string) int {
+	flags := flag.NewFlagSet("dir add", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "Configuration file to change")
+	retention := flags.String("retention", "", "File retention period (e.g. 30d)")
+	pattern := flags.String("pattern", "", "File matching pattern")
+	excludeSubdirs := flags.Bool("exclude-subdirs", false, "Do not process subdirectories")
+	removeEmptyDirs := flags.Bool("remove-empty-dirs", false, "Remove empty directories")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: filekeeper dir add PATH [--retention PERIOD] [--pattern PATTERN] [--exclude-subdirs] [--remove-empty-dirs] [--config PATH]")
+		return 2
+	}
+	dirPath := positional[0]
+
+	path := *configPath
+	if path == configFile {
+		path = findConfigFile(path)
+	}
+
+	// Relative paths would depend on the working directory of each run
+	if !filepath.IsAbs(dirPath) && !strings.HasPrefix(dirPath, "~") && !strings.HasPrefix(dirPath, "$") {
+		if abs, err := filepath.Abs(dirPath); err == nil {
+			dirPath = abs
+		}
+	}
+
+	// Only settings given on the command line are written
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	settings := [][2]string{{"path", dirPath}}
+	if given["retention"] {
+		settings = append(settings, [2]string{"retention_period", *retention})
+	}
+	if given["pattern"] {
+		settings = append(settings, [2]string{"file_pattern", *pattern})
+	}
+	if given["exclude-subdirs"] {
+		settings = append(settings, [2]string{"exclude_subdirs", strconv.FormatBool(*excludeSubdirs)})
+	}
+	if given["remove-empty-dirs"] {
+		settings = append(settings, [2]string{"remove_empty_dirs", strconv.FormatBool(*removeEmptyDirs)})
+	}
+
+	return editDirectories(path, fmt.Sprintf("Added directory %s to configuration %s", dirPath, path), func(doc *yaml.Node) error {
+		if *retention == "" {
+			_, defaults := mappingValue(doc, "defaults")
+			if _, value := mappingValue(defaults, "retention_period"); value == nil {
+				return fmt.Errorf("a retention period is required (use --retention or set one in defaults)")
+			}
+		}
+
+		dirs := directoryEntries(doc, true)
+		if findDirectoryEntry(dirs, dirPath) >= 0 {
+			return fmt.Errorf("directory %s is already configured", dirPath)
+		}
+
+		entry := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, setting := range settings {
+			if err := setDirectorySetting(entry, setting[0], setting[1]); err != nil {
+				return err
+			}
+		}
+		dirs.Style = 0
+		dirs.Content = append(dirs.Content, entry)
+		return nil
+	})
+}
+
+// runDirRemove implements the dir remove command and returns the exit code
+func runDirRemove(args []string) int {
+	flags := flag.NewFlagSet("dir remove", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "Configuration file to change")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: filekeeper dir remove PATH [--config PATH]")
+		return 2
+	}
+	dirPath := positional[0]
+
+	path := *configPath
+	if path == configFile {
+		path = findConfigFile(path)
+	}
+
+	return editDirectories(path, fmt.Sprintf("Removed directory %s from configuration %s", dirPath, path), func(doc *yaml.Node) error {
+		dirs := directoryEntries(doc, false)
+		index := findDirectoryEntry(dirs, dirPath)
+		if index < 0 {
+			return fmt.Errorf("directory %s is not configured", dirPath)
+		}
+		dirs.Content = append(dirs.Content[:index], dirs.Content[index+1:]...)
+		return nil
+	})
+}
+
+// runDirSet implements the dir set command and returns the exit code
+func runDirSet(args []string) int {
+	flags := flag.NewFlagSet("dir set", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "Configuration file to change")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 3 {
+		fmt.Fprintln(os.Stderr, "Usage: filekeeper dir set PATH SETTING VALUE [--config PATH]")
+		return 2
+	}
+	dirPath, key, value := positional[0], positional[1], positional[2]
+
+	path := *configPath
+	if path == configFile {
+		path = findConfigFile(path)
+	}
+
+	return editDirectories(path, fmt.Sprintf("Set %s of directory %s to %s in configuration %s", key, dirPath, value, path), func(doc *yaml.Node) error {
+		dirs := directoryEntries(doc, false)
+		index := findDirectoryEntry(dirs, dirPath)
+		if index < 0 {
+			return fmt.Errorf("directory %s is not configured", dirPath)
+		}
+		if key == "path" {
+			if other := findDirectoryEntry(dirs, value); other >= 0 && other != index {
+				return fmt.Errorf("directory %s is already configured", value)
+			}
+		}
+		return setDirectorySetting(dirs.Content[index], key, value)
+	})
+}
+
+// obfuscateFilename renames a file to a random name in the same directory before deletion
+func obfuscateFilename(tree *safeTree, path string, logger *log.Logger) (string, error) {
+	dir := filepath.Dir(path)
+
+	// Generate random name
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("failed to generate random name: %v", err)
+	}
+
+	randomName := hex.EncodeToString(randomBytes)
+
+	// Generate a random extension too (5 characters)
+	extRandomBytes := make([]byte, 3)
+	if _, err := rand.Read(extRandomBytes); err != nil {
+		return "", fmt.Errorf("failed to generate random extension: %v", err)
+	}
+	randomExt := "." + hex.EncodeToString(extRandomBytes)[:5]
+
+	newPath := filepath.Join(dir, randomName+randomExt)
+
+	// Rename the file
+	if err := tree.Rename(path, newPath); err != nil {
+		return "", fmt.Errorf("failed to rename file: %v", err)
+	}
+
+	return newPath, nil
+}
+
+// obfuscateDirectoryName renames a directory to a random name in its parent directory
+func obfuscateDirectoryName(tree *safeTree, dirPath string, logger *log.Logger) (string, error) {
+	parentDir := filepath.Dir(dirPath)
+
+	// Generate random name
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("failed to generate random name: %v", err)
+	}
+
+	randomName := hex.EncodeToString(randomBytes)
+	newPath := filepath.Join(parentDir, randomName)
+
+	// Rename the directory
+	if err := tree.Rename(dirPath, newPath); err != nil {
+		return "", fmt.Errorf("failed to rename directory: %v", err)
+	}
+
+	return newPath, nil
+}
+
+// atRemoveDir is the unlinkat flag that removes a directory
+const atRemoveDir = 0x200
+
+// errLeavesTree is returned for a path that lies outside the tree being
+// processed or would be reached through a symbolic link
+var errLeavesTree = errors.New("path leaves the directory tree")
+
+// testHookBeforeDelete, if set, is called before a file is deleted. Tests use
+// it to swap a directory for a symbolic link between the walk and the unlink.
+var testHookBeforeDelete func(path string)
+
+// safeTree is a directory tree whose root was resolved and opened once.
+// Files in it are opened, renamed and removed relative to a directory
+// descriptor opened from the root one component at a time without following
+// symbolic links, so a link swapped in during a run can't redirect a
+// deletion elsewhere. A nil *safeTree operates on plain paths.
+type safeTree struct {
+	root string
+	dir  *os.File
+}
+
+// openSafeTree resolves the symbolic links in path and opens the directory
+func openSafeTree(path string) (*safeTree, error) {
+	root, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	return &safeTree{root: root, dir: os.NewFile(uintptr(fd), root)}, nil
+}
+
+// Close closes the root directory
+func (t *safeTree) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.dir.Close()
+}
+
+// openParent opens the directory containing path and returns its descriptor
+// with the base name of path. Every directory on the way must be a real
+// directory inside the tree.
+func (t *safeTree) openParent(path string) (int, string, error) {
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return -1, "", fmt.Errorf("%s: %w %s", path, errLeavesTree, t.root)
+	}
+
+	const flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	fd, err := syscall.Openat(int(t.dir.Fd()), ".", flags, 0)
+	if err != nil {
+		return -1, "", &os.PathError{Op: "open", Path: t.root, Err: err}
+	}
+
+	dir, name := filepath.Split(rel)
+	for _, component := range strings.Split(filepath.Clean(dir), string(filepath.Separator)) {
+		if component == "." {
+			continue
+		}
+		next, err := syscall.Openat(fd, component, flags, 0)
+		syscall.Close(fd)
+		if err == syscall.ELOOP || err == syscall.ENOTDIR {
+			return -1, "", fmt.Errorf("%s: %w %s (%s is no longer a directory)", path, errLeavesTree, t.root, component)
+		}
+		if err != nil {
+			return -1, "", &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		fd = next
+	}
+
+	return fd, name, nil
+}
+
+// OpenFile opens a file in the tree without following a symbolic link
+func (t *safeTree) OpenFile(path string, flag int) (*os.File, error) {
+	if t == nil {
+		return os.OpenFile(path, flag, 0)
+	}
+	dirfd, name, err := t.openParent(path)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+
+	fd, err := syscall.Openat(dirfd, name, flag|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Remove removes a file from the tree
+func (t *safeTree) Remove(path string) error {
+	return t.unlink(path, 0)
+}
+
+// RemoveDir removes an empty directory from the tree
+func (t *safeTree) RemoveDir(path string) error {
+	return t.unlink(path, atRemoveDir)
+}
+
+func (t *safeTree) unlink(path string, flags int) error {
+	if t == nil {
+		return os.Remove(path)
+	}
+	dirfd, name, err := t.openParent(path)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(flags)); errno != 0 {
+		return &os.PathError{Op: "remove", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// Rename renames or moves a file or directory within the tree
+func (t *safeTree) Rename(oldPath, newPath string) error {
+	if t == nil {
+		return os.Rename(oldPath, newPath)
+	}
+	oldfd, oldName, err := t.openParent(oldPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(oldfd)
+	newfd, newName, err := t.openParent(newPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(newfd)
+
+	if err := syscall.Renameat(oldfd, oldName, newfd, newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// MkdirAll creates a directory in the tree along with any missing parents
+func (t *safeTree) MkdirAll(path string, perm uint32) error {
+	if t == nil {
+		return os.MkdirAll(path, os.FileMode(perm))
+	}
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s: %w %s", path, errLeavesTree, t.root)
+	}
+	if rel == "." {
+		return nil
+	}
+
+	const flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	fd, err := syscall.Openat(int(t.dir.Fd()), ".", flags, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: t.root, Err: err}
+	}
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		if err := syscall.Mkdirat(fd, component, perm); err != nil && err != syscall.EEXIST {
+			syscall.Close(fd)
+			return &os.PathError{Op: "mkdir", Path: path, Err: err}
+		}
+		next, err := syscall.Openat(fd, component, flags, 0)
+		syscall.Close(fd)
+		if err == syscall.ELOOP || err == syscall.ENOTDIR {
+			return fmt.Errorf("%s: %w %s (%s is not a directory)", path, errLeavesTree, t.root, component)
+		}
+		if err != nil {
+			return &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		fd = next
+	}
+	return syscall.Close(fd)
+}
+
+// inodeKey identifies a file independently of the name it is reached by
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkGroup collects the paths of one inode found during a run. Links
+// found by different directory entries carry the tree of their entry.
+type hardlinkGroup struct {
+	nlink uint64
+	paths []string
+	trees []*safeTree
+}
+
+// inodeKeyOf returns the device and inode numbers of a file
+func inodeKeyOf(info os.FileInfo) inodeKey {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return inodeKey{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+	}
+	return inodeKey{}
+}
+
+// deviceOf returns the device a file is on. It is a variable so tests can
+// simulate mount points.
+var deviceOf = func(info os.FileInfo) uint64 {
+	return inodeKeyOf(info).dev
+}
+
+// linkCount returns the number of hard links to a file
+func linkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
+
+// deleteFile removes a single file, obfuscating its name and overwriting its data if configured
+func deleteFile(ctx context.Context, tree *safeTree, path string, securityConfig SecurityConfig, logger *log.Logger) error {
+	return removeFile(ctx, tree, path, securityConfig.SecureDelete.Enabled, securityConfig, logger)
+}
+
+// removeFile removes a single file of tree, overwriting its data first if
+// shred is set. If the file can't be removed, an obfuscated name is rolled back
+// and the error is returned.
+func removeFile(ctx context.Context, tree *safeTree, path string, shred bool, securityConfig SecurityConfig, logger *log.Logger) error {
+	originalPath := path
+	if testHookBeforeDelete != nil {
+		testHookBeforeDelete(path)
+	}
+
+	// A symbolic link is removed, never the file it points to
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 && shred {
+		logger.Printf("File %s is a symbolic link, removing the link only", path)
+		shred = false
+	}
+
+	// Obfuscate filename if enabled (regardless of secure delete setting)
+	if securityConfig.SecureDelete.ObfuscateFilenames {
+		randomName, err := obfuscateFilename(tree, path, logger)
+		if err != nil {
+			logger.Printf("Error obfuscating filename %s: %v", path, err)
+		} else {
+			path = randomName
+			logger.Printf("Obfuscated filename to: %s", path)
+		}
+	}
+
+	// Perform the actual deletion (secure or regular)
+	var err error
+	if shred {
+		limiter, ok := ctx.Value(throttleKey{}).(*throttle)
+		if !ok {
+			limiter, _ = shredThrottleFor(ctx, securityConfig.SecureDelete)
+		}
+		if err = shredFile(ctx, tree, path, securityConfig.SecureDelete.Passes, limiter, logger); err == nil {
+			logger.Printf("Securely deleted file: %s", originalPath)
+		} else if ctx.Err() != nil && err == ctx.Err() {
+			logger.Printf("Left file %s: run was interrupted before overwriting started", originalPath)
+		} else {
+			logger.Printf("Error securely deleting file %s: %v", originalPath, err)
+		}
+	} else {
+		if err = tree.Remove(path); err != nil {
+			logger.Printf("Error deleting file %s: %v", originalPath, err)
+		} else {
+			logger.Printf("Deleted file: %s", originalPath)
+		}
+	}
+
+	// Don't leave a file behind under its random name
+	if err != nil && path != originalPath {
+		if _, statErr := os.Lstat(path); statErr == nil {
+			if renameErr := tree.Rename(path, originalPath); renameErr != nil {
+				logger.Printf("Error restoring name of %s (now %s): %v", originalPath, path, renameErr)
+			} else {
+				logger.Printf("Restored original name of %s", originalPath)
+			}
+		}
+	}
+	return err
+}
+
+// deleteHardlinkGroup applies the hardlink policy to an inode with several links.
+// If every link was found in this run the data is overwritten once and the
+// remaining links are unlinked; otherwise the policy decides what happens.
+// It returns how many links of the group were removed.
+func deleteHardlinkGroup(ctx context.Context, tree *safeTree, group *hardlinkGroup, policy string, securityConfig SecurityConfig, logger *log.Logger) int {
+	first := group.paths[0]
+
+	// Re-check the link count, it may have changed since the walk
+	if info, err := os.Lstat(first); err == nil {
+		group.nlink = linkCount(info)
+	}
+
+	removed := 0
+	remove := func(i int, shred bool) {
+		linkTree := tree
+		if group.trees != nil {
+			linkTree = group.trees[i]
+		}
+		if removeFile(ctx, linkTree, group.paths[i], shred, securityConfig, logger) == nil {
+			removed++
+		}
+	}
+
+	outside := int(group.nlink) - len(group.paths)
+	if outside <= 0 {
+		logger.Printf("All %d hard links of %s are expired, overwriting the data once", len(group.paths), first)
+		for i := 1; i < len(group.paths); i++ {
+			remove(i, false)
+		}
+		remove(0, true)
+		return removed
+	}
+
+	switch policy {
+	case HardlinkPolicyShred:
+		logger.Printf("Warning: %s has %d hard links outside this run, overwriting anyway (hardlink_policy: shred)", first, outside)
+		for i := 1; i < len(group.paths); i++ {
+			remove(i, false)
+		}
+		remove(0, true)
+	case HardlinkPolicyUnlink:
+		for i, path := range group.paths {
+			logger.Printf("File %s has %d hard links outside this run, unlinking without overwriting (hardlink_policy: unlink)", path, outside)
+			remove(i, false)
+		}
+	default:
+		for _, path := range group.paths {
+			logger.Printf("Skipping file %s: it has %d hard links outside this run (hardlink_policy: skip)", path, outside)
+		}
+	}
+	return removed
+}
+
+// runHardlinks collects, across the directory entries of a run, the
+// hard-linked files whose links were not all found by their own entry.
+// Once every entry has been processed, the links found by different
+// entries are handled as one inode.
+type runHardlinks struct {
+	mu     sync.Mutex
+	groups map[inodeKey]*runHardlinkGroup
+	order  []inodeKey
+}
+
+// runHardlinkGroup is an inode collected by runHardlinks. It is deleted with
+// the settings of the first entry that found it.
+type runHardlinkGroup struct {
+	group    hardlinkGroup
+	roots    []string
+	policy   string
+	security SecurityConfig
+	logger   *log.Logger
+}
+
+// hardlinksKey is the context key of the run's runHardlinks
+type hardlinksKey struct{}
+
+// add records the links of an inode found in the tree rooted at root
+func (r *runHardlinks) add(key inodeKey, root string, group *hardlinkGroup, policy string, security SecurityConfig, logger *log.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found, ok := r.groups[key]
+	if !ok {
+		found = &runHardlinkGroup{group: hardlinkGroup{nlink: group.nlink}, policy: policy, security: security, logger: logger}
+		r.groups[key] = found
+		r.order = append(r.order, key)
+	}
+	// Overlapping entries find the same links again
+	for _, path := range group.paths {
+		if !containsString(found.group.paths, path) {
+			found.group.paths = append(found.group.paths, path)
+			found.roots = append(found.roots, root)
+		}
+	}
+}
+
+// delete applies the hardlink policy to every collected inode, unless ctx
+// has been cancelled
+func (r *runHardlinks) delete(ctx context.Context, logger *log.Logger) {
+	trees := make(map[string]*safeTree)
+	defer func() {
+		for _, tree := range trees {
+			tree.Close()
+		}
+	}()
+
+	for i, key := range r.order {
+		found := r.groups[key]
+		if ctx.Err() != nil {
+			left := 0
+			for _, key := range r.order[i:] {
+				left += len(r.groups[key].group.paths)
+			}
+			logger.Printf("Left %d hard-linked files (%v)", left, context.Cause(ctx))
+			return
+		}
+
+		group := found.group
+		group.trees = nil
+		for _, root := range found.roots {
+			tree, ok := trees[root]
+			if !ok {
+				var err error
+				if tree, err = openSafeTree(root); err != nil {
+					found.logger.Printf("Error deleting hard links of %s: %v", group.paths[0], err)
+					break
+				}
+				trees[root] = tree
+			}
+			group.trees = append(group.trees, tree)
+		}
+		if len(group.trees) == len(group.paths) {
+			limiter, _ := shredThrottleFor(ctx, found.security.SecureDelete)
+			deleteHardlinkGroup(context.WithValue(ctx, throttleKey{}, limiter), nil, &group, found.policy, found.security, found.logger)
+		}
+	}
+}
+
+// quarantineDirName is the directory in the root of a directory entry that
+// holds quarantined files. It is never scanned for expired files.
+const quarantineDirName = ".filekeeper-quarantine"
+
+// quarantineTimeFormat starts the name of a quarantine batch
+const quarantineTimeFormat = "20060102T150405Z"
+
+// quarantinePurgeInterval is how often watch mode purges quarantines
+const quarantinePurgeInterval = time.Hour
+
+// quarantine moves expired files of a tree into batches below
+// quarantineDirName, keeping their paths relative to the root, and purges
+// the batches once the grace period has passed. A batch is named after the
+// time it was started.
+type quarantine struct {
+	tree   *safeTree
+	dir    string
+	period time.Duration
+	batch  string
+}
+
+// newQuarantine returns the quarantine of tree with the given grace period
+func newQuarantine(tree *safeTree, period time.Duration) *quarantine {
+	return &quarantine{tree: tree, dir: filepath.Join(tree.root, quarantineDirName), period: period}
+}
+
+// add moves a file into the current batch, starting one if needed
+func (q *quarantine) add(path string, logger *log.Logger) {
+	if q.batch == "" {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			logger.Printf("Error quarantining file %s: %v", path, err)
+			return
+		}
+		q.batch = filepath.Join(q.dir, time.Now().UTC().Format(quarantineTimeFormat)+"-"+hex.EncodeToString(suffix))
+	}
+
+	rel, err := filepath.Rel(q.tree.root, path)
+	if err != nil {
+		logger.Printf("Error quarantining file %s: %v", path, err)
+		return
+	}
+	target := filepath.Join(q.batch, rel)
+	if err := q.tree.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		logger.Printf("Error quarantining file %s: %v", path, err)
+		return
+	}
+	if err := q.tree.Rename(path, target); err != nil {
+		logger.Printf("Error quarantining file %s: %v", path, err)
+		return
+	}
+	logger.Printf("Quarantined file: %s", path)
+}
+
+// rotate makes the next add start a new batch
+func (q *quarantine) rotate() {
+	q.batch = ""
+}
+
+// batchTime returns the time a batch was started from its name
+func batchTime(name string) (time.Time, bool) {
+	prefix, _, _ := strings.Cut(name, "-")
+	t, err := time.Parse(quarantineTimeFormat, prefix)
+	return t, err == nil
+}
+
+// purge deletes the batches whose grace period has passed by now, with the
+// security settings of the directory
+func (q *quarantine) purge(ctx context.Context, now time.Time, security SecurityConfig, logger *log.Logger) {
+	batches, err := os.ReadDir(q.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Printf("Error reading quarantine %s: %v", q.dir, err)
+		}
+		return
+	}
+
+	for _, batch := range batches {
+		started, ok := batchTime(batch.Name())
+		if !ok || !batch.IsDir() || started.Add(q.period).After(now) || ctx.Err() != nil {
+			continue
+		}
+		path := filepath.Join(q.dir, batch.Name())
+		if security.DryRun {
+			logger.Printf("Would purge quarantine batch %s (quarantined %s)", path, started.Format(time.RFC3339))
+			continue
+		}
+
+		// Files first, then the directories from the deepest. Hard links
+		// quarantined together are deleted as one group.
+		policy := security.SecureDelete.HardlinkPolicy
+		if policy == "" {
+			policy = HardlinkPolicySkip
+		}
+		var files, removed int
+		var dirs []string
+		groups := make(map[inodeKey]*hardlinkGroup)
+		var order []inodeKey
+		filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil || ctx.Err() != nil {
+				return nil
+			}
+			if info.IsDir() {
+				dirs = append(dirs, file)
+				return nil
+			}
+			files++
+			if nlink := linkCount(info); security.SecureDelete.Enabled && nlink > 1 {
+				key := inodeKeyOf(info)
+				group, ok := groups[key]
+				if !ok {
+					group = &hardlinkGroup{nlink: nlink}
+					groups[key] = group
+					order = append(order, key)
+				}
+				group.paths = append(group.paths, file)
+				return nil
+			}
+			if deleteFile(ctx, q.tree, file, security, logger) == nil {
+				removed++
+			}
+			return nil
+		})
+		for _, key := range order {
+			removed += deleteHardlinkGroup(ctx, q.tree, groups[key], policy, security, logger)
+		}
+		if removed < files || ctx.Err() != nil {
+			logger.Printf("Kept quarantine batch %s: removed %d of %d files quarantined %s", path, removed, files, started.Format(time.RFC3339))
+			continue
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := q.tree.RemoveDir(dirs[i]); err != nil {
+				logger.Printf("Error removing quarantine directory %s: %v", dirs[i], err)
+			}
+		}
+		logger.Printf("Purged quarantine batch %s: %d files quarantined %s", path, removed, started.Format(time.RFC3339))
+	}
+
+	if empty, err := isDirEmpty(q.dir); err == nil && empty && !security.DryRun {
+		q.tree.RemoveDir(q.dir)
+	}
+}
+
+// quarantinedFile is a file waiting in quarantine
+type quarantinedFile struct {
+	Path        string // original location
+	Stored      string // location in the quarantine
+	Quarantined time.Time
+}
+
+// list returns the files in the quarantine, oldest batch first
+func (q *quarantine) list() ([]quarantinedFile, error) {
+	batches, err := os.ReadDir(q.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []quarantinedFile
+	for _, batch := range batches {
+		started, ok := batchTime(batch.Name())
+		if !ok || !batch.IsDir() {
+			continue
+		}
+		batchDir := filepath.Join(q.dir, batch.Name())
+		filepath.Walk(batchDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			rel, _ := filepath.Rel(batchDir, path)
+			files = append(files, quarantinedFile{Path: filepath.Join(q.tree.root, rel), Stored: path, Quarantined: started})
+			return nil
+		})
+	}
+	return files, nil
+}
+
+// restore moves a quarantined file back to its original location, setting
+// its modification time to now if touch is set. An existing file is never
+// replaced.
+func (q *quarantine) restore(file quarantinedFile, touch bool) error {
+	if _, err := os.Lstat(file.Path); err == nil {
+		return fmt.Errorf("%s already exists", file.Path)
+	}
+	if err := q.tree.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+		return err
+	}
+	if err := q.tree.Rename(file.Stored, file.Path); err != nil {
+		return err
+	}
+	if touch {
+		now := time.Now()
+		if err := os.Chtimes(file.Path, now, now); err != nil {
+			return err
+		}
+	}
+
+	// Remove directories of the batch left empty
+	for dir := filepath.Dir(file.Stored); dir != q.dir && strings.HasPrefix(dir, q.dir); dir = filepath.Dir(dir) {
+		if empty, err := isDirEmpty(dir); err != nil || !empty || q.tree.RemoveDir(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// RunDirectoryContext processes a directory entry, stopping early when ctx
+// is cancelled. A path containing glob patterns is expanded at run time and
+// every matching directory is processed with the entry's settings; failures
+// are reported under the originating entry.
+func RunDirectoryContext(ctx context.Context, dirConfig DirectoryConfig, securityConfig SecurityConfig, logger *log.Logger) error {
+	protected, _ := ctx.Value(protectedKey{}).([]string)
+	if !strings.ContainsAny(dirConfig.Path, "*?[") {
+		if reason := protectedPath(dirConfig.Path, protected); reason != "" && !dirConfig.AllowProtectedPath {
+			return fmt.Errorf("%s; set allow_protected_path: true on the entry to process it anyway", reason)
+		}
+		return ProcessDirectoryContext(ctx, dirConfig, securityConfig, logger)
+	}
+
+	matches, err := expandDirectoryConfig(dirConfig)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Directory pattern %s matched %d directories", dirConfig.Path, len(matches))
+
+	// Directories matching the pattern may have been created since loading
+	if !dirConfig.AllowProtectedPath {
+		allowed := matches[:0]
+		for _, match := range matches {
+			if reason := protectedPath(match.Path, protected); reason != "" {
+				logger.Printf("Skipping directory %s (from %s): %s; set allow_protected_path: true on the entry to process it anyway", match.Path, dirConfig.Path, reason)
+				continue
+			}
+			allowed = append(allowed, match)
+		}
+		matches = allowed
+	}
+
+	var failures []string
+	var limitErr *LimitError
+	for _, match := range matches {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := ProcessDirectoryContext(ctx, match, securityConfig, logger); err != nil {
+			logger.Printf("Error processing directory %s (from %s): %v", match.Path, dirConfig.Path, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", match.Path, err))
+			if limitErr == nil {
+				errors.As(err, &limitErr)
+			}
+		}
+	}
+
+	if len(failures) > 0 && limitErr != nil {
+		return fmt.Errorf("%d of %d matching directories failed: %w; %s", len(failures), len(matches), limitErr, strings.Join(failures, "; "))
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d matching directories failed: %s", len(failures), len(matches), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// LimitError reports that a run limit was reached
+type LimitError struct {
+	Scope string // "run" or "directory PATH"
+	Limit string // max_runtime, max_deletions or max_bytes
+	Value string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s limit of %s reached", e.Scope, e.Limit, e.Value)
+}
+
+// runBudget enforces the limits of a run or of one directory. Budgets nest:
+// a deletion counts against a directory's budget and the run's budget.
+type runBudget struct {
+	scope        string
+	maxRuntime   time.Duration
+	maxDeletions int64
+	maxBytes     int64
+	runtimeValue string
+	bytesValue   string
+	parent       *runBudget
+
+	mu        sync.Mutex
+	deletions int64
+	bytes     int64
+	exceeded  *LimitError
+}
+
+// budgetKey is the context key of the innermost budget
+type budgetKey struct{}
+
+// newRunBudget parses limits; empty or zero values mean unlimited
+func newRunBudget(scope, maxRuntime string, maxDeletions int, maxBytes string) (*runBudget, error) {
+	b := &runBudget{scope: scope, maxDeletions: int64(maxDeletions), runtimeValue: maxRuntime, bytesValue: maxBytes}
+	if maxRuntime != "" {
+		d, err := ParseDuration(maxRuntime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_runtime '%s': %v", maxRuntime, err)
+		}
+		b.maxRuntime = d
+	}
+	if maxBytes != "" {
+		n, err := ParseSize(maxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_bytes '%s': %v", maxBytes, err)
+		}
+		b.maxBytes = n
+	}
+	return b, nil
+}
+
+// begin starts the budget under ctx, inside the budget already in ctx if
+// any. When max_runtime passes the returned context is cancelled with a
+// *LimitError as cause, stopping the run like a signal would; done
+// releases it.
+func (b *runBudget) begin(ctx context.Context) (context.Context, func()) {
+	b.parent, _ = ctx.Value(budgetKey{}).(*runBudget)
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	var timer *time.Timer
+	if b.maxRuntime > 0 {
+		timer = time.AfterFunc(b.maxRuntime, func() {
+			cancel(&LimitError{Scope: b.scope, Limit: "max_runtime", Value: b.runtimeValue})
+		})
+	}
+
+	return context.WithValue(ctx, budgetKey{}, b), func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		cancel(nil)
+	}
+}
+
+// take counts the deletion of a file of size bytes against this budget and
+// its parents. It returns the limit that deleting it would exceed, if any.
+// Deletions already counted are unaffected, so files queued for deletion
+// within the limits are still deleted.
+func (b *runBudget) take(size int64) *LimitError {
+	for budget := b; budget != nil; budget = budget.parent {
+		if err := budget.reserve(size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserve counts a deletion against this budget only. Once a limit is
+// reached every further deletion is refused.
+func (b *runBudget) reserve(size int64) *LimitError {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.exceeded == nil && b.maxDeletions > 0 && b.deletions+1 > b.maxDeletions {
+		b.exceeded = &LimitError{Scope: b.scope, Limit: "max_deletions", Value: strconv.FormatInt(b.maxDeletions, 10)}
+	}
+	if b.exceeded == nil && b.maxBytes > 0 && b.bytes+size > b.maxBytes {
+		b.exceeded = &LimitError{Scope: b.scope, Limit: "max_bytes", Value: b.bytesValue}
+	}
+	if b.exceeded != nil {
+		return b.exceeded
+	}
+
+	b.deletions++
+	b.bytes += size
+	return nil
+}
+
+// limitReached returns the limit reached by this budget or its parents, if any
+func (b *runBudget) limitReached() *LimitError {
+	for budget := b; budget != nil; budget = budget.parent {
+		budget.mu.Lock()
+		exceeded := budget.exceeded
+		budget.mu.Unlock()
+		if exceeded != nil {
+			return exceeded
+		}
+	}
+	return nil
+}
+
+// RunDirectories processes every directory entry of a configuration. Up to
+// general.workers independent entries run in parallel, each logging with its
+// path as prefix; entries whose paths overlap run one after another in
+// configuration order. It returns an error if any entry failed. When ctx is
+// cancelled, entries not started yet are skipped and listed in a summary.
+func RunDirectories(ctx context.Context, config Config, logger *log.Logger) error {
+	dirs := config.Directories
+	workers := config.General.Workers
+	if workers > len(dirs) {
+		workers = len(dirs)
+	}
+
+	// Limits for the whole run
+	budget, err := newRunBudget("run", config.General.MaxRuntime, config.General.MaxDeletions, config.General.MaxBytes)
+	if err != nil {
+		return err
+	}
+	runCtx, done := budget.begin(ctx)
+	defer done()
+
+	// Hard links found by several entries are deleted once all have run
+	hardlinks := &runHardlinks{groups: make(map[inodeKey]*runHardlinkGroup)}
+	runCtx = context.WithValue(runCtx, hardlinksKey{}, hardlinks)
+
+	// Directories created since loading are checked against the protected
+	// paths as they are now
+	protected, err := protectedPathList(config)
+	if err != nil {
+		return err
+	}
+	runCtx = context.WithValue(runCtx, protectedKey{}, protected)
+
+	// Overwrites of every entry share one pool, as large as the largest
+	// workers setting, and the throughput limit of the security settings
+	shredWorkers, shredding := 0, false
+	for _, dirConfig := range dirs {
+		security := dirConfig.EffectiveSecurity(config.Security)
+		if security.SecureDelete.Enabled && !security.DryRun {
+			shredding = true
+			if security.SecureDelete.Workers > shredWorkers {
+				shredWorkers = security.SecureDelete.Workers
+			}
+		}
+	}
+	if shredding {
+		limiter, err := shredThrottleFor(ctx, config.Security.SecureDelete)
+		if err != nil {
+			return err
+		}
+		pool := newShredPool(shredWorkers)
+		defer pool.wait()
+		runCtx = context.WithValue(context.WithValue(runCtx, throttleKey{}, limiter), shredPoolKey{}, pool)
+	}
+
+	stopped := func() bool {
+		return runCtx.Err() != nil || budget.limitReached() != nil
+	}
+
+	var mu sync.Mutex
+	var failures int
+	var limits []*LimitError
+	var interrupted, skipped []string
+	run := func(dirConfig DirectoryConfig, logger *log.Logger) {
+		if stopped() {
+			mu.Lock()
+			skipped = append(skipped, dirConfig.Path)
+			mu.Unlock()
+			return
+		}
+		if dirConfig.Security != nil {
+			logger.Printf("Using directory-specific security settings for %s", dirConfig.Path)
+		}
+		err := RunDirectoryContext(runCtx, dirConfig, dirConfig.EffectiveSecurity(config.Security), logger)
+
+		mu.Lock()
+		defer mu.Unlock()
+		var limitErr *LimitError
+		if err != nil && stopped() {
+			interrupted = append(interrupted, dirConfig.Path)
+		} else if err != nil {
+			logger.Printf("Error processing directory %s: %v", dirConfig.Path, err)
+			fmt.Fprintf(os.Stderr, "Error processing directory %s: %v\n", dirConfig.Path, err)
+			failures++
+			if errors.As(err, &limitErr) {
+				limits = append(limits, limitErr)
+			}
+		}
+	}
+
+	if workers <= 1 {
+		for _, dirConfig := range dirs {
+			run(dirConfig, logger)
+		}
+	} else {
+		groups := overlappingGroups(dirs)
+		logger.Printf("Processing %d directories with %d workers (%d independent groups)", len(dirs), workers, len(groups))
+
+		queue := make(chan []int)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for group := range queue {
+					for _, index := range group {
+						dirConfig := dirs[index]
+						prefixed := log.New(logger.Writer(), "["+dirConfig.Path+"] ", logger.Flags()|log.Lmsgprefix)
+						run(dirConfig, prefixed)
+					}
+				}
+			}()
+		}
+		for _, group := range groups {
+			queue <- group
+		}
+		close(queue)
+		wg.Wait()
+	}
+	hardlinks.delete(runCtx, logger)
+
+	if stopped() {
+		summary := fmt.Sprintf("%d directories stopped early, %d not started", len(interrupted), len(skipped))
+		if len(interrupted) > 0 {
+			summary += "; stopped: " + strings.Join(interrupted, ", ")
+		}
+		if len(skipped) > 0 {
+			summary += "; not started: " + strings.Join(skipped, ", ")
+		}
+
+		// A run limit, or an interruption from outside
+		limitErr := budget.limitReached()
+		if limitErr == nil && ctx.Err() == nil {
+			errors.As(context.Cause(runCtx), &limitErr)
+		}
+		if limitErr != nil {
+			return fmt.Errorf("%w; %s", limitErr, summary)
+		}
+		return fmt.Errorf("run interrupted: %s", summary)
+	}
+	if len(limits) > 0 {
+		return fmt.Errorf("%d of %d directories failed: %w", failures, len(dirs), limits[0])
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d of %d directories failed", failures, len(dirs))
+	}
+	return nil
+}
+
+// overlappingGroups splits directory entries into groups that can run in
+// parallel. Entries whose paths are the same or nested in one another end up
+// in the same group, in configuration order.
+func overlappingGroups(dirs []DirectoryConfig) [][]int {
+	// Union-find over the entries
+	parent := make([]int, len(dirs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	roots := make([]string, len(dirs))
+	for i, dirConfig := range dirs {
+		roots[i] = overlapRoot(dirConfig.Path)
+	}
+	for i := range dirs {
+		for j := i + 1; j < len(dirs); j++ {
+			if pathsOverlap(roots[i], roots[j]) {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	var groups [][]int
+	groupOf := make(map[int]int)
+	for i := range dirs {
+		root := find(i)
+		index, ok := groupOf[root]
+		if !ok {
+			index = len(groups)
+			groupOf[root] = index
+			groups = append(groups, nil)
+		}
+		groups[index] = append(groups[index], i)
+	}
+	return groups
+}
+
+// overlapRoot returns the directory a path can affect: the part before the
+// first glob pattern, with symbolic links resolved where possible
+func overlapRoot(path string) string {
+	if i := strings.IndexAny(path, "*?["); i >= 0 {
+		path = filepath.Dir(path[:i+1])
+	}
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path
+}
+
+// pathsOverlap reports whether one path is the same as or inside the other
+func pathsOverlap(a, b string) bool {
+	return pathWithin(a, b) || pathWithin(b, a)
+}
+
+// pathWithin reports whether child is the same as or inside parent
+func pathWithin(child, parent string) bool {
+	return child == parent || parent == string(filepath.Separator) || strings.HasPrefix(child, parent+string(filepath.Separator))
+}
+
+// expandDirectoryConfig expands a directory entry whose path contains glob
+// patterns into one entry per matching directory
+func expandDirectoryConfig(dirConfig DirectoryConfig) ([]DirectoryConfig, error) {
+	paths, err := filepath.Glob(dirConfig.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path pattern '%s': %v", dirConfig.Path, err)
+	}
+
+	var matches []DirectoryConfig
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		match := dirConfig
+		match.Path = path
+		matches = append(matches, match)
+	}
+
+	return matches, nil
+}
+
+// defaultMassDeletePercent is the share of the files of a directory above
+// which the mass-deletion guard trips
+const defaultMassDeletePercent = 80
+
+// MassDeleteError reports a directory left alone by the mass-deletion guard
+type MassDeleteError struct {
+	Path       string
+	Candidates int
+	Total      int
+	Percent    int
+}
+
+func (e *MassDeleteError) Error() string {
+	return fmt.Sprintf("refusing to delete %d of %d files (%d%%) in %s, more than %d%%; set allow_mass_delete or use --force if this is intended",
+		e.Candidates, e.Total, e.Candidates*100/e.Total, e.Path, e.Percent)
+}
+
+// checkMassDelete counts the files of a directory entry and those older than
+// cutoff, and returns a *MassDeleteError if too many of them would be deleted
+func checkMassDelete(dirConfig DirectoryConfig, cutoff time.Time, logger *log.Logger) error {
+	percent := dirConfig.MassDeletePercent
+	if percent == 0 {
+		percent = defaultMassDeletePercent
+	}
+
+	rootInfo, err := os.Lstat(dirConfig.Path)
+	if err != nil {
+		return err
+	}
+	rootDev := deviceOf(rootInfo)
+
+	quarantineDir := filepath.Join(dirConfig.Path, quarantineDirName)
+
+	var candidates, total int
+	err = filepath.Walk(dirConfig.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dirConfig.Path {
+			return nil
+		}
+		if path == quarantineDir {
+			return filepath.SkipDir
+		}
+		if dirConfig.OneFileSystem && deviceOf(info) != rootDev {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if dirConfig.ExcludeSubdirs {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if dirConfig.FilePattern != "" {
+			if match, err := filepath.Match(dirConfig.FilePattern, filepath.Base(path)); err != nil || !match {
+				return nil
+			}
+		}
+		total++
+		if info.ModTime().Before(cutoff) {
+			candidates++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Planning: %d of %d files in %s are expired", candidates, total, dirConfig.Path)
+	if candidates > 0 && candidates >= dirConfig.MassDeleteMinFiles && candidates*100 > total*percent {
+		return &MassDeleteError{Path: dirConfig.Path, Candidates: candidates, Total: total, Percent: percent}
+	}
+	return nil
+}
+
+// ProcessDirectory processes a directory according to its configuration
+func ProcessDirectory(dirConfig DirectoryConfig, securityConfig SecurityConfig, logger *log.Logger) error {
+	return ProcessDirectoryContext(context.Background(), dirConfig, securityConfig, logger)
+}
+
+// ProcessDirectoryContext is ProcessDirectory stopping when ctx is cancelled.
+// Files being deleted are finished; files not yet started are left alone, a
+// summary of what was left is logged and ctx.Err() is returned.
+func ProcessDirectoryContext(ctx context.Context, dirConfig DirectoryConfig, securityConfig SecurityConfig, logger *log.Logger) error {
+	logger.Printf("Processing directory: %s", dirConfig.Path)
+
+	// Check if directory exists
+	if _, err := os.Stat(dirConfig.Path); os.IsNotExist(err) {
+		return fmt.Errorf("directory does not exist: %s", dirConfig.Path)
+	}
+
+	// Resolve the directory once; everything is deleted relative to it
+	tree, err := openSafeTree(dirConfig.Path)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	if tree.root != filepath.Clean(dirConfig.Path) {
+		logger.Printf("Directory %s resolves to %s", dirConfig.Path, tree.root)
+		dirConfig.Path = tree.root
+	}
+	rootInfo, err := tree.dir.Stat()
+	if err != nil {
+		return err
+	}
+	rootDev := deviceOf(rootInfo)
+
+	// When recording a plan nothing is deleted; the files are added to the plan
+	var planned *PlanDirectory
+	if plan, ok := ctx.Value(planKey{}).(*Plan); ok {
+		planned = &PlanDirectory{Path: dirConfig.Path, Rule: planRule(dirConfig), Security: securityConfig, QuarantinePeriod: dirConfig.QuarantinePeriod}
+		defer plan.add(planned)
+		securityConfig.DryRun = true
+	}
+
+	// Expired files are moved into the quarantine instead of being deleted
+	var q *quarantine
+	action := "delete"
+	if dirConfig.QuarantinePeriod != "" {
+		period, err := ParseDuration(dirConfig.QuarantinePeriod)
+		if err != nil {
+			return fmt.Errorf("invalid quarantine period '%s': %v", dirConfig.QuarantinePeriod, err)
+		}
+		q, action = newQuarantine(tree, period), "quarantine"
+	}
+
+	// Parse retention period
+	retention, err := ParseDuration(dirConfig.RetentionPeriod)
+	if err != nil {
+		return fmt.Errorf("invalid retention period '%s': %v", dirConfig.RetentionPeriod, err)
+	}
+
+	// Calculate cutoff time
+	cutoff := time.Now().Add(-retention)
+	logger.Printf("Retention period: %s (removing files before %s)", dirConfig.RetentionPeriod, cutoff.Format(time.RFC3339))
+
+	// Limits for this directory, counted within those of the run
+	budget, err := newRunBudget("directory "+dirConfig.Path, dirConfig.MaxRuntime, dirConfig.MaxDeletions, dirConfig.MaxBytes)
+	if err != nil {
+		return err
+	}
+	ctx, done := budget.begin(ctx)
+	defer done()
+
+	// Check hardlink policy
+	hardlinkPolicy := securityConfig.SecureDelete.HardlinkPolicy
+	if hardlinkPolicy == "" {
+		hardlinkPolicy = HardlinkPolicySkip
+	}
+	switch hardlinkPolicy {
+	case HardlinkPolicySkip, HardlinkPolicyUnlink, HardlinkPolicyShred:
+	default:
+		return fmt.Errorf("invalid hardlink policy '%s' (expected skip, unlink or shred)", hardlinkPolicy)
+	}
+
+	// Refuse to delete most of the directory, usually a sign of a clock jump
+	// or a wrong path
+	if !dirConfig.AllowMassDelete {
+		if err := checkMassDelete(dirConfig, cutoff, logger); err != nil {
+			return err
+		}
+	}
+
+	// Hard-linked files found during the walk, keyed by inode
+	hardlinks := make(map[inodeKey]*hardlinkGroup)
+	var hardlinkOrder []inodeKey
+
+	// Secure deletion runs in a worker pool so the walk isn't blocked by
+	// overwrites. Within a run every directory shares the run's pool.
+	var pool *shredBatch
+	if securityConfig.SecureDelete.Enabled && !securityConfig.DryRun {
+		limiter, err := shredThrottleFor(ctx, securityConfig.SecureDelete)
+		if err != nil {
+			return err
+		}
+		ctx = context.WithValue(ctx, throttleKey{}, limiter)
+		shared, ok := ctx.Value(shredPoolKey{}).(*shredPool)
+		if !ok {
+			shared = newShredPool(securityConfig.SecureDelete.Workers)
+			defer shared.wait()
+		}
+		pool = shared.batch()
+		defer pool.wait()
+	}
+
+	// Expired files left when the run is interrupted, and where the walk stopped
+	var left int64
+	var stoppedAt string
+	var limitErr *LimitError
+
+	// Mount points skipped to stay on the root's filesystem
+	var mountPoints []string
+
+	// Prepare to walk directory
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			stoppedAt = path
+			return ctx.Err()
+		}
+		if err != nil {
+			logger.Printf("Error accessing path %s: %v", path, err)
+			return nil // Continue walking
+		}
+
+		// Skip the root directory itself and the quarantine
+		if path == dirConfig.Path {
+			return nil
+		}
+		if info.IsDir() && info.Name() == quarantineDirName && filepath.Dir(path) == dirConfig.Path {
+			return filepath.SkipDir
+		}
+
+		// Stay on the root's filesystem if configured
+		if dirConfig.OneFileSystem && deviceOf(info) != rootDev {
+			if info.IsDir() {
+				logger.Printf("Skipping mount point %s: it is on a different filesystem", path)
+				mountPoints = append(mountPoints, path)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip directories if we're not removing empty ones or if we're excluding subdirectories
+		if info.IsDir() {
+			if dirConfig.ExcludeSubdirs && path != dirConfig.Path {
+				return filepath.SkipDir
+			}
+			// We'll handle directories in a second pass
+			return nil
+		}
+
+		// Check if the file matches the pattern
+		if dirConfig.FilePattern != "" {
+			match, err := filepath.Match(dirConfig.FilePattern, filepath.Base(path))
+			if err != nil {
+				logger.Printf("Error matching pattern '%s' for file %s: %v", dirConfig.FilePattern, path, err)
+				return nil
+			}
+			if !match {
+				return nil // Skip files that don't match the pattern
+			}
+		}
+
+		// Check if the file is older than the cutoff
+		if info.ModTime().Before(cutoff) {
+			if err := budget.take(info.Size()); err != nil {
+				limitErr, stoppedAt = err, path
+				return err
+			}
+
+			if securityConfig.DryRun {
+				logger.Printf("Would %s file: %s (modified: %s)", action, path, info.ModTime().Format(time.RFC3339))
+				if planned != nil {
+					planned.Files = append(planned.Files, newPlanFile(path, info))
+				} else {
+					fmt.Printf("Would %s file: %s (modified: %s)\n", action, path, info.ModTime().Format(time.RFC3339))
+				}
+				if nlink := linkCount(info); securityConfig.SecureDelete.Enabled && nlink > 1 {
+					logger.Printf("File %s has %d hard links (hardlink_policy: %s)", path, nlink, hardlinkPolicy)
+				}
+				return nil
+			}
+
+			// Quarantined files are deleted when they are purged
+			if q != nil {
+				q.add(path, logger)
+				return nil
+			}
+
+			// Files with several links are collected and handled after the walk,
+			// once we know how many of their links belong to this run
+			if nlink := linkCount(info); securityConfig.SecureDelete.Enabled && nlink > 1 {
+				key := inodeKeyOf(info)
+				group, ok := hardlinks[key]
+				if !ok {
+					group = &hardlinkGroup{nlink: nlink}
+					hardlinks[key] = group
+					hardlinkOrder = append(hardlinkOrder, key)
+				}
+				group.paths = append(group.paths, path)
+				return nil
+			}
+
+			if pool != nil {
+				pool.submit(func() {
+					if ctx.Err() != nil {
+						atomic.AddInt64(&left, 1)
+						return
+					}
+					deleteFile(ctx, tree, path, securityConfig, logger)
+				})
+			} else {
+				deleteFile(ctx, tree, path, securityConfig, logger)
+			}
+		}
+
+		return nil
+	}
+
+	// Walk the directory
+	walkErr := filepath.Walk(dirConfig.Path, walkFn)
+	if walkErr != nil && limitErr == nil && ctx.Err() == nil {
+		return walkErr
+	}
+	if len(mountPoints) > 0 {
+		logger.Printf("Skipped %d mount points in %s (one_file_system): %s", len(mountPoints), dirConfig.Path, strings.Join(mountPoints, ", "))
+	}
+
+	// Handle hard-linked files collected during the walk. Within a run, those
+	// with links this entry didn't find wait for the other entries.
+	run, _ := ctx.Value(hardlinksKey{}).(*runHardlinks)
+	for _, key := range hardlinkOrder {
+		group := hardlinks[key]
+		if run != nil && int(group.nlink) > len(group.paths) {
+			if ctx.Err() != nil {
+				atomic.AddInt64(&left, int64(len(group.paths)))
+			} else {
+				run.add(key, tree.root, group, hardlinkPolicy, securityConfig, logger)
+			}
+			continue
+		}
+		pool.submit(func() {
+			if ctx.Err() != nil {
+				atomic.AddInt64(&left, int64(len(group.paths)))
+				return
+			}
+			deleteHardlinkGroup(ctx, tree, group, hardlinkPolicy, securityConfig, logger)
+		})
+	}
+
+	// Wait for pending overwrites before looking for empty directories
+	pool.wait()
+	if ctx.Err() != nil {
+		if walkErr != nil {
+			logger.Printf("Stopped processing directory %s at %s (%v): %d expired files were left, the rest of the directory was not checked",
+				dirConfig.Path, stoppedAt, context.Cause(ctx), left)
+		} else {
+			logger.Printf("Stopped processing directory %s (%v): %d expired files were left, empty directories were not removed",
+				dirConfig.Path, context.Cause(ctx), left)
+		}
+		return context.Cause(ctx)
+	}
+	if limitErr != nil {
+		logger.Printf("Stopped processing directory %s at %s: %v; the rest of the directory was not checked", dirConfig.Path, stoppedAt, limitErr)
+		return limitErr
+	}
+
+	// Delete what has been in the quarantine for long enough
+	if q != nil && planned == nil {
+		q.purge(ctx, time.Now(), securityConfig, logger)
+	}
+
+	// Second pass: remove empty directories if configured
+	if dirConfig.RemoveEmptyDirs {
+		logger.Printf("Checking for empty directories in %s", dirConfig.Path)
+
+		// We need to walk from the deepest directories first
+		var dirs []string
+		walkDirsFn := func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil // Continue walking
+			}
+			if info.IsDir() && path != dirConfig.Path {
+				if dirConfig.OneFileSystem && deviceOf(info) != rootDev || path == filepath.Join(dirConfig.Path, quarantineDirName) {
+					return filepath.SkipDir
+				}
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+
+		if err := filepath.Walk(dirConfig.Path, walkDirsFn); err != nil {
+			return err
+		}
+
+		// Sort directories by depth (most nested first)
+		for i := len(dirs) - 1; i >= 0; i-- {
+			dir := dirs[i]
+
+			// Skip if we're excluding subdirectories
+			if dirConfig.ExcludeSubdirs && dir != dirConfig.Path {
+				continue
+			}
+
+			// Check if directory is empty
+			empty, err := isDirEmpty(dir)
+			if err != nil {
+				logger.Printf("Error checking if directory %s is empty: %v", dir, err)
+				continue
+			}
+
+			if empty {
+				if securityConfig.DryRun {
+					logger.Printf("Would remove empty directory: %s", dir)
+				} else {
+					originalDir := dir
+					// Obfuscate directory name if enabled
+					if securityConfig.SecureDelete.ObfuscateFilenames {
+						randomName, err := obfuscateDirectoryName(tree, dir, logger)
+						if err != nil {
+							logger.Printf("Error obfuscating directory name %s: %v", dir, err)
+						} else {
+							dir = randomName
+							logger.Printf("Obfuscated directory name to: %s", dir)
+						}
+					}
+
+					if err := tree.RemoveDir(dir); err != nil {
+						logger.Printf("Error removing directory %s: %v", originalDir, err)
+					} else {
+						logger.Printf("Removed empty directory: %s", originalDir)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// isDirEmpty checks if a directory is empty
+func isDirEmpty(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// Try to read just one file
+	_, err = f.Readdirnames(1)
+	if err == nil {
+		// Directory is not empty
+		return false, nil
+	}
+	if err != nil && err.Error() == "EOF" {
+		// Directory is empty
+		return true, nil
+	}
+	return false, err
+}
+
+// shredPool runs secure deletion jobs on a fixed number of workers
+type shredPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// shredPoolKey is the context key of the pool shared by a run
+type shredPoolKey struct{}
+
+// newShredPool starts a pool with the given number of workers (at least one)
+func newShredPool(workers int) *shredPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	pool := &shredPool{jobs: make(chan func(), workers)}
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for job := range pool.jobs {
+				job()
+			}
+		}()
+	}
+	return pool
+}
+
+// submit queues a job, blocking while all workers are busy.
+// On a nil pool the job runs inline.
+func (p *shredPool) submit(job func()) {
+	if p == nil {
+		job()
+		return
+	}
+	p.jobs <- job
+}
+
+// wait stops accepting jobs and waits for the queued ones to finish
+func (p *shredPool) wait() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() { close(p.jobs) })
+	p.wg.Wait()
+}
+
+// shredBatch is the jobs of one directory on a pool that may be shared
+type shredBatch struct {
+	pool *shredPool
+	wg   sync.WaitGroup
+}
+
+// batch returns a batch of jobs running on the pool
+func (p *shredPool) batch() *shredBatch {
+	return &shredBatch{pool: p}
+}
+
+// submit queues a job on the pool. On a nil batch the job runs inline.
+func (b *shredBatch) submit(job func()) {
+	if b == nil {
+		job()
+		return
+	}
+	b.wg.Add(1)
+	b.pool.submit(func() {
+		defer b.wg.Done()
+		job()
+	})
+}
+
+// wait waits for the jobs of the batch to finish
+func (b *shredBatch) wait() {
+	if b == nil {
+		return
+	}
+	b.wg.Wait()
+}
+
+// throttle limits the combined write rate of all secure deletion workers.
+// A throttle within another one also waits for its parent.
+type throttle struct {
+	mu     sync.Mutex
+	rate   int64     // bytes per second
+	next   time.Time // when the next write may start
+	parent *throttle
+}
+
+// wait blocks until n more bytes may be written without exceeding the rate
+func (t *throttle) wait(n int) {
+	if t == nil {
+		return
+	}
+	defer t.parent.wait(n)
+	if t.rate <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	start := t.next
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	t.mu.Unlock()
+
+	time.Sleep(time.Until(start))
+}
+
+// throttleKey is the context key of the throttle of a run or directory
+type throttleKey struct{}
+
+// shredThrottleFor returns the throttle for the configured rate, within the
+// throttle of the run in ctx if any. It is nil if nothing limits the rate.
+func shredThrottleFor(ctx context.Context, config SecureDeleteConfig) (*throttle, error) {
+	run, _ := ctx.Value(throttleKey{}).(*throttle)
+	if config.MaxBytesPerSecond == "" {
+		return run, nil
+	}
+
+	rate, err := ParseSize(config.MaxBytesPerSecond)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max_bytes_per_second '%s': %v", config.MaxBytesPerSecond, err)
+	}
+	if rate == 0 || run != nil && run.rate == rate {
+		return run, nil
+	}
+	return &throttle{rate: rate, parent: run}, nil
+}
+
+// shredFile overwrites and removes a file, keeping the write rate under the
+// limiter. If ctx is cancelled before the first pass the file is left
+// untouched and ctx.Err() is returned; once a pass has completed the file
+// is removed after the current pass, since its data is already destroyed.
+func shredFile(ctx context.Context, tree *safeTree, path string, passes int, limiter *throttle, logger *log.Logger) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Open the file for writing
+	file, err := tree.OpenFile(path, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Get file info for size
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Create a buffer for overwriting
+	size := info.Size()
+	buf := make([]byte, 8192) // Use a reasonable buffer size
+
+	// Perform the secure deletion passes
+	for pass := 0; pass < passes; pass++ {
+		if pass > 0 && ctx.Err() != nil {
+			logger.Printf("Interrupted after secure delete pass %d/%d for %s, removing the overwritten file", pass, passes, path)
+			break
+		}
+		logger.Printf("Secure delete pass %d/%d for %s", pass+1, passes, path)
+
+		// Reset to beginning of file
+		if _, err := file.Seek(0, 0); err != nil {
+			return err
+		}
+
+		// Fill the buffer with random data for this pass
+		for i := range buf {
+			buf[i] = byte(pass ^ i)
+		}
+
+		// Write the random data to the file
+		remaining := size
+		for remaining > 0 {
+			writeSize := int64(len(buf))
+			if remaining < writeSize {
+				writeSize = remaining
+			}
+
+			limiter.wait(int(writeSize))
+			if _, err := file.Write(buf[:writeSize]); err != nil {
+				return err
+			}
+
+			remaining -= writeSize
+		}
+
+		// Flush to disk
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// Final deletion
+	return tree.Remove(path)
+}
+
+// RunLock is an exclusive lock that keeps runs from overlapping
+type RunLock struct {
+	file *os.File
+}
+
+// runLockRetry is how long the daemon and the watcher postpone work when
+// another run holds the run lock
+const runLockRetry = time.Minute
+
+// AcquireRunLock takes the run lock at path, recording our PID in it. If
+// another process holds it, wait decides between waiting for it to be
+// released and failing with an error naming the holding PID.
+func AcquireRunLock(path string, wait bool) (*RunLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		holder := "unknown pid"
+		if pid := lockHolder(file); pid > 0 {
+			holder = fmt.Sprintf("pid %d", pid)
+		}
+		if !wait {
+			file.Close()
+			return nil, fmt.Errorf("another %s run is in progress (%s, lock file %s)", ProgramName, holder, path)
+		}
+		fmt.Fprintf(os.Stderr, "Waiting for another %s run to finish (%s, lock file %s)\n", ProgramName, holder, path)
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+
+	// Record our PID for anyone who finds the lock taken
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return &RunLock{file: file}, nil
+}
+
+// lockHolder returns the PID recorded in a lock file, or 0
+func lockHolder(file *os.File) int {
+	data := make([]byte, 32)
+	n, _ := file.ReadAt(data, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Release releases the lock. The lock file is kept, since removing it would
+// let a waiting process and a new one lock different files.
+func (l *RunLock) Release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+}
+
+// applyDryRun turns on dry-run mode globally and in every directory override
+func applyDryRun(config *Config) {
+	config.Security.DryRun = true
+	for _, dirConfig := range config.Directories {
+		if dirConfig.Security != nil {
+			dirConfig.Security.DryRun = true
+		}
+	}
+}
+
+// applyForce turns off the mass-deletion guard of every directory entry
+func applyForce(config *Config) {
+	for i := range config.Directories {
+		config.Directories[i].AllowMassDelete = true
+	}
+}
+
+// scheduledDirectory is a directory entry run by the daemon on its schedule
+type scheduledDirectory struct {
+	dir      DirectoryConfig
+	schedule Schedule
+	next     time.Time
+}
+
+// Daemon runs directory entries on their schedules until it is stopped
+type Daemon struct {
+	ConfigPath string
+	Profile    string
+	DryRun     bool
+	Force      bool
+	LockFile   string // run lock taken for each pass, if set
+
+	config  Config
+	logger  *log.Logger
+	entries []*scheduledDirectory
+}
+
+// Load loads the configuration and schedules every directory entry that has
+// a schedule, starting from now. On error the previous configuration is kept.
+func (d *Daemon) Load(now time.Time) error {
+	config, err := LoadConfigProfile(d.ConfigPath, d.Profile)
+	if err != nil {
+		return err
+	}
+	if d.DryRun {
+		applyDryRun(&config)
+	}
+	if d.Force {
+		applyForce(&config)
+	}
+
+	var entries []*scheduledDirectory
+	var unscheduled []string
+	for _, dirConfig := range config.Directories {
+		if dirConfig.Schedule == "" {
+			unscheduled = append(unscheduled, dirConfig.Path)
+			continue
+		}
+		schedule, err := ParseSchedule(dirConfig.Schedule)
+		if err != nil {
+			return fmt.Errorf("directory %s: %v", dirConfig.Path, err)
+		}
+		entries = append(entries, &scheduledDirectory{dir: dirConfig, schedule: schedule, next: schedule.Next(now)})
+	}
+
+	// Reopening the log file lets it be rotated with a reload
+	logger, err := setupLogger(config.General.Logging)
+	if err != nil {
+		return err
+	}
+	closeLogger(d.logger)
+	d.config, d.logger, d.entries = config, logger, entries
+
+	for _, warning := range config.Warnings {
+		logger.Printf("Warning: %s", warning)
+	}
+	logger.Printf("Configuration loaded from: %s", d.ConfigPath)
+	if d.Profile != "" {
+		logger.Printf("Using profile: %s", d.Profile)
+	}
+	if config.Security.DryRun {
+		logger.Printf("Running in dry-run mode - no files will be deleted")
+	}
+	for _, path := range unscheduled {
+		logger.Printf("Directory %s has no schedule and is not run by the daemon", path)
+	}
+	for _, entry := range entries {
+		logger.Printf("Directory %s scheduled (%s), next run at %s", entry.dir.Path, entry.dir.Schedule, entry.next.Format(time.RFC3339))
+	}
+	if len(entries) == 0 {
+		logger.Printf("No directory has a schedule; waiting for a configuration reload")
+	}
+
+	return nil
+}
+
+// Run runs directory entries when they are due until ctx is cancelled. A
+// value on reload reloads the configuration. Load must have been called.
+// A run in progress when ctx is cancelled stops after the current file.
+func (d *Daemon) Run(ctx context.Context, reload <-chan struct{}) {
+	d.logger.Printf("Starting %s v%s daemon", ProgramName, ProgramVersion)
+
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if next := d.nextRun(); !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			d.logger.Printf("Daemon stopped")
+			closeLogger(d.logger)
+			return
+		case <-reload:
+			if err := d.Load(time.Now()); err != nil {
+				d.logger.Printf("Error reloading configuration, keeping the previous one: %v", err)
+				fmt.Fprintf(os.Stderr, "Error reloading configuration from %s: %v\n", d.ConfigPath, err)
+			} else {
+				d.logger.Printf("Configuration reloaded")
+			}
+		case now := <-due:
+			d.runDue(ctx, now)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// nextRun returns the earliest next run of all entries, or the zero time
+func (d *Daemon) nextRun() time.Time {
+	var next time.Time
+	for _, entry := range d.entries {
+		if !entry.next.IsZero() && (next.IsZero() || entry.next.Before(next)) {
+			next = entry.next
+		}
+	}
+	return next
+}
+
+// runDue runs the entries that are due at now and schedules their next run
+func (d *Daemon) runDue(ctx context.Context, now time.Time) {
+	// Don't overlap with one-shot runs, or with another daemon
+	if d.LockFile != "" {
+		runLock, err := AcquireRunLock(d.LockFile, false)
+		if err != nil {
+			retry := now.Add(runLockRetry)
+			d.logger.Printf("Postponing due directories to %s: %v", retry.Format(time.RFC3339), err)
+			for _, entry := range d.entries {
+				if !entry.next.IsZero() && !entry.next.After(now) {
+					entry.next = retry
+				}
+			}
+			return
+		}
+		defer runLock.Release()
+	}
+
+	var due []*scheduledDirectory
+	for _, entry := range d.entries {
+		if !entry.next.IsZero() && !entry.next.After(now) {
+			due = append(due, entry)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	// Due directories run together like a one-shot run, sharing its workers
+	// and run-wide limits
+	if !d.config.General.Enabled && !d.Force {
+		for _, entry := range due {
+			d.logger.Printf("Program is disabled in configuration, skipping directory %s", entry.dir.Path)
+		}
+	} else {
+		config := d.config
+		config.Directories = make([]DirectoryConfig, len(due))
+		for i, entry := range due {
+			config.Directories[i] = entry.dir
+		}
+		if err := RunDirectories(ctx, config, d.logger); err != nil {
+			var limitErr *LimitError
+			if ctx.Err() == nil && errors.As(err, &limitErr) {
+				d.logger.Printf("Stopped at a limit, %v", err)
+			} else {
+				d.logger.Printf("Finished processing due directories: %v", err)
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	for _, entry := range due {
+		entry.next = entry.schedule.Next(time.Now())
+		if entry.next.IsZero() {
+			d.logger.Printf("Directory %s has no further scheduled runs", entry.dir.Path)
+		} else {
+			d.logger.Printf("Next run of directory %s at %s", entry.dir.Path, entry.next.Format(time.RFC3339))
+		}
+	}
+}
+
+// closeLogger closes the log file of a logger created by setupLogger
+func closeLogger(logger *log.Logger) {
+	if logger == nil {
+		return
+	}
+	if file, ok := logger.Writer().(*os.File); ok && file != os.Stdout && file != os.Stderr {
+		file.Close()
+	}
+}
+
+// runDaemon implements the daemon command and returns the exit code
+func runDaemon(args []string) int {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	d := &Daemon{LockFile: lockFile}
+	flags.StringVar(&d.ConfigPath, "config", configFile, "Configuration file to use")
+	flags.StringVar(&d.Profile, "profile", "", "Apply the named profile from the configuration")
+	flags.BoolVar(&d.DryRun, "dry-run", false, "Run without actually deleting any files")
+	flags.BoolVar(&d.Force, "force", false, "Run even if disabled in the configuration or the mass-deletion guard trips")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if d.ConfigPath == configFile {
+		d.ConfigPath = findConfigFile(d.ConfigPath)
+	}
+
+	if err := d.Load(time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration from %s: %v\n", d.ConfigPath, err)
+		return 1
+	}
+
+	// SIGHUP reloads the configuration; SIGTERM and SIGINT stop the daemon
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan struct{}, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				cancel()
+				return
 			}
-			if info.IsDir() && path != dirConfig.Path {
-				dirs = append(dirs, path)
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	fmt.Printf("%s daemon started with %d scheduled directories (pid %d)\n", ProgramName, len(d.entries), os.Getpid())
+	d.Run(ctx, reload)
+	fmt.Printf("%s daemon stopped\n", ProgramName)
+	return 0
+}
+
+// watchEvents are the inotify events the watcher reacts to
+const watchEvents = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+// watchedDirectory is a directory entry enforced by the watcher
+type watchedDirectory struct {
+	dir       DirectoryConfig
+	security  SecurityConfig
+	retention time.Duration
+	tree      *safeTree
+	dev       uint64
+
+	quarantinePeriod time.Duration
+	quarantine       *quarantine
+	stopped          *LimitError // limit reached, files are kept until the next reload
+}
+
+// watchedFile is a file waiting in the expiry queue
+type watchedFile struct {
+	path   string
+	expiry time.Time
+	entry  *watchedDirectory
+	index  int // position in the queue
+}
+
+// expiryQueue is a min-heap of files ordered by expiry time
+type expiryQueue []*watchedFile
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].expiry.Before(q[j].expiry) }
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *expiryQueue) Push(x interface{}) {
+	item := x.(*watchedFile)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// inotifyEvent is an event read from the inotify file descriptor
+type inotifyEvent struct {
+	wd   int32
+	mask uint32
+	name string
+}
+
+// Watcher removes files as soon as they cross the retention period. It
+// tracks file creation and changes with inotify and keeps the files of the
+// configured directories in an in-memory expiry queue instead of scanning.
+type Watcher struct {
+	ConfigPath string
+	Profile    string
+	DryRun     bool
+	Force      bool
+	LockFile   string // run lock taken while deleting, if set
+
+	config    Config
+	logger    *log.Logger
+	nextPurge time.Time
+	inotify   *os.File
+	events    chan []inotifyEvent
+	stop      chan struct{}
+	watches   map[int32]string
+	entryOf   map[string]*watchedDirectory
+	roots     []*watchedDirectory
+	queue     expiryQueue
+	queued    map[string]*watchedFile // queue entry of each path
+	stopped   *LimitError             // run limit reached, nothing is deleted until the next reload
+}
+
+// Load loads the configuration, sets up inotify watches for every directory
+// entry and queues the files already present. On error the previous state is kept.
+func (w *Watcher) Load() error {
+	config, err := LoadConfigProfile(w.ConfigPath, w.Profile)
+	if err != nil {
+		return err
+	}
+	if w.DryRun {
+		applyDryRun(&config)
+	}
+	if w.Force {
+		applyForce(&config)
+	}
+
+	// Expand patterns and check the settings of every entry first
+	if _, err := newRunBudget("run", config.General.MaxRuntime, config.General.MaxDeletions, config.General.MaxBytes); err != nil {
+		return err
+	}
+	protected, err := protectedPathList(config)
+	if err != nil {
+		return err
+	}
+	var roots []*watchedDirectory
+	for _, dirConfig := range config.Directories {
+		matches := []DirectoryConfig{dirConfig}
+		if strings.ContainsAny(dirConfig.Path, "*?[") {
+			if matches, err = expandDirectoryConfig(dirConfig); err != nil {
+				return err
+			}
+		}
+		retention, err := ParseDuration(dirConfig.RetentionPeriod)
+		if err != nil {
+			return fmt.Errorf("directory %s: invalid retention period '%s': %v", dirConfig.Path, dirConfig.RetentionPeriod, err)
+		}
+		security := dirConfig.EffectiveSecurity(config.Security)
+		switch security.SecureDelete.HardlinkPolicy {
+		case "", HardlinkPolicySkip, HardlinkPolicyUnlink, HardlinkPolicyShred:
+		default:
+			return fmt.Errorf("directory %s: invalid hardlink policy '%s' (expected skip, unlink or shred)", dirConfig.Path, security.SecureDelete.HardlinkPolicy)
+		}
+		var quarantinePeriod time.Duration
+		if dirConfig.QuarantinePeriod != "" {
+			if quarantinePeriod, err = ParseDuration(dirConfig.QuarantinePeriod); err != nil {
+				return fmt.Errorf("directory %s: invalid quarantine period '%s': %v", dirConfig.Path, dirConfig.QuarantinePeriod, err)
+			}
+		}
+		if _, err := newRunBudget("directory "+dirConfig.Path, dirConfig.MaxRuntime, dirConfig.MaxDeletions, dirConfig.MaxBytes); err != nil {
+			return fmt.Errorf("directory %s: %v", dirConfig.Path, err)
+		}
+		for _, match := range matches {
+			roots = append(roots, &watchedDirectory{dir: match, security: security, retention: retention, quarantinePeriod: quarantinePeriod})
+		}
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to initialize inotify: %v", err)
+	}
+	logger, err := setupLogger(config.General.Logging)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	// Replace the previous state
+	w.Close()
+	closeLogger(w.logger)
+	w.config, w.logger, w.roots = config, logger, roots
+	w.inotify = os.NewFile(uintptr(fd), "inotify")
+	w.events = make(chan []inotifyEvent)
+	w.stop = make(chan struct{})
+	w.watches = make(map[int32]string)
+	w.entryOf = make(map[string]*watchedDirectory)
+	w.queue = nil
+	w.queued = make(map[string]*watchedFile)
+	w.stopped = nil
+	go w.readEvents(w.inotify, w.events, w.stop)
+
+	for _, warning := range config.Warnings {
+		logger.Printf("Warning: %s", warning)
+	}
+	logger.Printf("Configuration loaded from: %s", w.ConfigPath)
+	if config.Security.DryRun {
+		logger.Printf("Running in dry-run mode - no files will be deleted")
+	}
+
+	// Watches are added before scanning so no new file is missed. Glob
+	// matches are checked against the protected paths here.
+	for _, root := range roots {
+		if reason := protectedPath(root.dir.Path, protected); reason != "" && !root.dir.AllowProtectedPath {
+			logger.Printf("Not watching directory %s: %s; set allow_protected_path: true on the entry to process it anyway", root.dir.Path, reason)
+			continue
+		}
+		tree, err := openSafeTree(root.dir.Path)
+		if err != nil {
+			logger.Printf("Error watching directory %s: %v", root.dir.Path, err)
+			continue
+		}
+		root.tree, root.dir.Path = tree, tree.root
+		if root.dir.QuarantinePeriod != "" {
+			root.quarantine = newQuarantine(tree, root.quarantinePeriod)
+		}
+		if info, err := tree.dir.Stat(); err == nil {
+			root.dev = deviceOf(info)
+		}
+
+		// Files that have already expired are deleted right away, so the
+		// mass-deletion guard applies as in a run
+		if !root.dir.AllowMassDelete {
+			if err := checkMassDelete(root.dir, time.Now().Add(-root.retention), logger); err != nil {
+				logger.Printf("Error: not watching directory %s: %v", root.dir.Path, err)
+				fmt.Fprintf(os.Stderr, "Error: not watching directory %s: %v\n", root.dir.Path, err)
+				tree.Close()
+				root.tree, root.quarantine = nil, nil
+				continue
 			}
+		}
+
+		if err := w.addDirectory(root, root.dir.Path); err != nil {
+			logger.Printf("Error watching directory %s: %v", root.dir.Path, err)
+			continue
+		}
+		logger.Printf("Watching directory %s (retention %s)", root.dir.Path, root.dir.RetentionPeriod)
+	}
+	logger.Printf("%d files queued for expiry", len(w.queue))
+
+	return nil
+}
+
+// Close stops watching; queued files are forgotten
+func (w *Watcher) Close() {
+	if w.inotify != nil {
+		close(w.stop)
+		w.inotify.Close()
+		w.inotify = nil
+	}
+	for _, root := range w.roots {
+		root.tree.Close()
+		root.tree = nil
+	}
+}
+
+// addDirectory watches a directory (and its subdirectories unless excluded)
+// and queues the files in it
+func (w *Watcher) addDirectory(entry *watchedDirectory, dir string) error {
+	if dir == filepath.Join(entry.dir.Path, quarantineDirName) {
+		return nil
+	}
+	if entry.dir.OneFileSystem && dir != entry.dir.Path {
+		if info, err := os.Lstat(dir); err == nil && deviceOf(info) != entry.dev {
+			w.logger.Printf("Skipping mount point %s: it is on a different filesystem", dir)
 			return nil
 		}
+	}
+
+	// New subdirectories may match protected path patterns
+	if dir != entry.dir.Path && len(w.config.General.ProtectedPaths) > 0 && !entry.dir.AllowProtectedPath {
+		protected, _ := protectedPathList(w.config)
+		for _, path := range protected {
+			if pathWithin(dir, path) {
+				w.logger.Printf("Not watching directory %s: it is inside protected path %s", dir, path)
+				return nil
+			}
+		}
+	}
+
+	wd, err := syscall.InotifyAddWatch(int(w.inotify.Fd()), dir, watchEvents)
+	if err != nil {
+		if err == syscall.ENOSPC {
+			return fmt.Errorf("inotify watch limit reached, raise fs.inotify.max_user_watches")
+		}
+		return err
+	}
+	w.watches[int32(wd)] = dir
+	w.entryOf[dir] = entry
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, item := range entries {
+		path := filepath.Join(dir, item.Name())
+		if item.IsDir() {
+			if !entry.dir.ExcludeSubdirs {
+				if err := w.addDirectory(entry, path); err != nil {
+					w.logger.Printf("Error watching directory %s: %v", path, err)
+				}
+			}
+			continue
+		}
+		w.queueFile(entry, path)
+	}
+	return nil
+}
+
+// queueFile puts a file in the expiry queue, or updates its expiry time
+func (w *Watcher) queueFile(entry *watchedDirectory, path string) {
+	if entry.dir.FilePattern != "" {
+		if match, err := filepath.Match(entry.dir.FilePattern, filepath.Base(path)); err != nil || !match {
+			return
+		}
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil || info.IsDir() {
+		return
+	}
+	if entry.dir.OneFileSystem && deviceOf(info) != entry.dev {
+		return
+	}
+
+	// A file changed again keeps its place in the queue, moved to its new expiry
+	expiry := info.ModTime().Add(entry.retention)
+	if item, ok := w.queued[path]; ok {
+		if !item.expiry.Equal(expiry) || item.entry != entry {
+			item.expiry, item.entry = expiry, entry
+			heap.Fix(&w.queue, item.index)
+		}
+		return
+	}
+	item := &watchedFile{path: path, expiry: expiry, entry: entry}
+	w.queued[path] = item
+	heap.Push(&w.queue, item)
+}
+
+// readEvents reads inotify events until the file is closed or stop is closed
+func (w *Watcher) readEvents(file *os.File, events chan<- []inotifyEvent, stop <-chan struct{}) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			select {
+			case <-stop:
+			default:
+				close(events)
+			}
+			return
+		}
+
+		var batch []inotifyEvent
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(raw.Len)], "\x00"))
+			batch = append(batch, inotifyEvent{wd: raw.Wd, mask: raw.Mask, name: name})
+			offset = nameStart + int(raw.Len)
+		}
+		select {
+		case events <- batch:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleEvent updates the watches and the expiry queue for an inotify event
+func (w *Watcher) handleEvent(event inotifyEvent) {
+	if event.mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.logger.Printf("Warning: inotify event queue overflowed, rescanning all directories")
+		for _, root := range w.roots {
+			if err := w.addDirectory(root, root.dir.Path); err != nil {
+				w.logger.Printf("Error watching directory %s: %v", root.dir.Path, err)
+			}
+		}
+		return
+	}
+
+	dir, ok := w.watches[event.wd]
+	if !ok {
+		return
+	}
+	if event.mask&(syscall.IN_IGNORED|syscall.IN_DELETE_SELF) != 0 {
+		delete(w.watches, event.wd)
+		delete(w.entryOf, dir)
+		for _, root := range w.roots {
+			if root.dir.Path == dir {
+				w.logger.Printf("Warning: watched directory %s was removed", dir)
+			}
+		}
+		return
+	}
+
+	entry := w.entryOf[dir]
+	path := filepath.Join(dir, event.name)
+	switch {
+	case event.mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		if item, ok := w.queued[path]; ok {
+			heap.Remove(&w.queue, item.index)
+			delete(w.queued, path)
+		}
+	case event.mask&syscall.IN_ISDIR != 0:
+		if event.mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && !entry.dir.ExcludeSubdirs {
+			if err := w.addDirectory(entry, path); err != nil {
+				w.logger.Printf("Error watching directory %s: %v", path, err)
+			}
+		}
+	default:
+		w.queueFile(entry, path)
+	}
+}
+
+// expire removes the queued files whose expiry time has passed. Files that
+// are gone are dropped; files changed since they were queued are requeued
+// with their current time.
+func (w *Watcher) expire(ctx context.Context, now time.Time) {
+	// Each pass is limited like a run, and the files of each directory like
+	// the directory in a run
+	budget, _ := newRunBudget("run", w.config.General.MaxRuntime, w.config.General.MaxDeletions, w.config.General.MaxBytes)
+	ctx, done := budget.begin(ctx)
+	defer done()
+	type directoryBudget struct {
+		budget *runBudget
+		ctx    context.Context
+	}
+	budgets := make(map[*watchedDirectory]directoryBudget)
+	var dones []func()
+	defer func() {
+		for _, done := range dones {
+			done()
+		}
+	}()
+	budgetOf := func(entry *watchedDirectory) directoryBudget {
+		b, ok := budgets[entry]
+		if !ok {
+			b.budget, _ = newRunBudget("directory "+entry.dir.Path, entry.dir.MaxRuntime, entry.dir.MaxDeletions, entry.dir.MaxBytes)
+			var done func()
+			b.ctx, done = b.budget.begin(ctx)
+			budgets[entry] = b
+			dones = append(dones, done)
+		}
+		return b
+	}
+
+	// Hard-linked files are collected and handled after the others, as in a
+	// run, so that links expiring together count as one group
+	type groupKey struct {
+		entry *watchedDirectory
+		inode inodeKey
+	}
+	groups := make(map[groupKey]*hardlinkGroup)
+	var order []groupKey
+
+	for w.stopped == nil && len(w.queue) > 0 && !w.queue[0].expiry.After(now) && ctx.Err() == nil {
+		item := heap.Pop(&w.queue).(*watchedFile)
+		delete(w.queued, item.path)
+
+		// The file may have changed without an event reaching us yet
+		info, err := os.Lstat(item.path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Add(item.entry.retention).After(now) {
+			w.queueFile(item.entry, item.path)
+			continue
+		}
+
+		security := item.entry.security
+		if !w.config.General.Enabled && !w.Force {
+			w.logger.Printf("Program is disabled in configuration, keeping file %s", item.path)
+			continue
+		}
+
+		// Files of a directory that reached a limit are queued again on reload
+		if item.entry.stopped != nil {
+			continue
+		}
+		b := budgetOf(item.entry)
+		if b.ctx.Err() != nil {
+			w.limitReached(item.entry, context.Cause(b.ctx))
+		} else if err := b.budget.take(info.Size()); err != nil {
+			w.limitReached(item.entry, err)
+		}
+		if item.entry.stopped != nil {
+			continue
+		}
+		if w.stopped != nil || b.ctx.Err() != nil {
+			w.queueFile(item.entry, item.path)
+			continue
+		}
+
+		if security.DryRun {
+			w.logger.Printf("Would delete file: %s (modified: %s)", item.path, info.ModTime().Format(time.RFC3339))
+			fmt.Printf("Would delete file: %s (modified: %s)\n", item.path, info.ModTime().Format(time.RFC3339))
+			continue
+		}
+		if q := item.entry.quarantine; q != nil {
+			q.add(item.path, w.logger)
+		} else if nlink := linkCount(info); security.SecureDelete.Enabled && nlink > 1 {
+			key := groupKey{entry: item.entry, inode: inodeKeyOf(info)}
+			group := groups[key]
+			if group == nil {
+				group = &hardlinkGroup{nlink: nlink}
+				groups[key] = group
+				order = append(order, key)
+			}
+			group.paths = append(group.paths, item.path)
+			continue
+		} else {
+			deleteFile(b.ctx, item.entry.tree, item.path, security, w.logger)
+		}
+
+		if item.entry.dir.RemoveEmptyDirs {
+			w.removeEmptyParents(item.entry, filepath.Dir(item.path))
+		}
+	}
+	if ctx.Err() != nil {
+		w.limitReached(nil, context.Cause(ctx))
+	}
+
+	// Hard-linked files were collected within the limits
+	for _, key := range order {
+		dirCtx := budgetOf(key.entry).ctx
+		if dirCtx.Err() != nil {
+			continue
+		}
+		security := key.entry.security
+		policy := security.SecureDelete.HardlinkPolicy
+		if policy == "" {
+			policy = HardlinkPolicySkip
+		}
+		deleteHardlinkGroup(dirCtx, key.entry.tree, groups[key], policy, security, w.logger)
+		if key.entry.dir.RemoveEmptyDirs {
+			for _, path := range groups[key].paths {
+				w.removeEmptyParents(key.entry, filepath.Dir(path))
+			}
+		}
+	}
+
+	// Files expiring later go into a batch of their own
+	for _, root := range w.roots {
+		if root.quarantine != nil {
+			root.quarantine.rotate()
+		}
+	}
+}
+
+// limitReached stops deleting once a limit is reached: in the directory for
+// a directory limit, everywhere for a run limit, until the configuration is
+// reloaded. Causes other than a limit, such as a signal, are ignored.
+func (w *Watcher) limitReached(entry *watchedDirectory, cause error) {
+	var limitErr *LimitError
+	if !errors.As(cause, &limitErr) {
+		return
+	}
+	if limitErr.Scope != "run" && entry != nil {
+		if entry.stopped == nil {
+			entry.stopped = limitErr
+			w.logger.Printf("Stopped deleting in %s until the configuration is reloaded: %v", entry.dir.Path, limitErr)
+			fmt.Fprintf(os.Stderr, "Stopped deleting in %s until the configuration is reloaded: %v\n", entry.dir.Path, limitErr)
+		}
+		return
+	}
+	if w.stopped == nil {
+		w.stopped = limitErr
+		w.logger.Printf("Stopped deleting until the configuration is reloaded: %v", limitErr)
+		fmt.Fprintf(os.Stderr, "Stopped deleting until the configuration is reloaded: %v\n", limitErr)
+	}
+}
+
+// purgeQuarantines deletes quarantined files whose grace period has passed
+func (w *Watcher) purgeQuarantines(ctx context.Context, now time.Time) {
+	if !w.config.General.Enabled && !w.Force {
+		return
+	}
+	for _, root := range w.roots {
+		if root.quarantine != nil && ctx.Err() == nil {
+			root.quarantine.purge(ctx, now, root.security, w.logger)
+		}
+	}
+}
+
+// removeEmptyParents removes dir and its parents below the entry's root
+// while they are empty
+func (w *Watcher) removeEmptyParents(entry *watchedDirectory, dir string) {
+	for dir != entry.dir.Path && strings.HasPrefix(dir, entry.dir.Path+string(filepath.Separator)) {
+		if empty, err := isDirEmpty(dir); err != nil || !empty {
+			return
+		}
+		if err := entry.tree.RemoveDir(dir); err != nil {
+			w.logger.Printf("Error removing directory %s: %v", dir, err)
+			return
+		}
+		w.logger.Printf("Removed empty directory: %s", dir)
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Run enforces the retention periods until ctx is cancelled. A value on
+// reload reloads the configuration. Load must have been called.
+func (w *Watcher) Run(ctx context.Context, reload <-chan struct{}) {
+	w.logger.Printf("Starting %s v%s in watch mode", ProgramName, ProgramVersion)
+
+	for {
+		// Delete under the run lock, postponing while another run holds it
+		now := time.Now()
+		quarantined := false
+		for _, root := range w.roots {
+			quarantined = quarantined || root.quarantine != nil
+		}
+		expired := w.stopped == nil && len(w.queue) > 0 && !w.queue[0].expiry.After(now)
+		purge := quarantined && !now.Before(w.nextPurge)
+		postponed := false
+		if expired || purge {
+			var runLock *RunLock
+			var err error
+			if w.LockFile != "" {
+				runLock, err = AcquireRunLock(w.LockFile, false)
+			}
+			if err != nil {
+				w.logger.Printf("Postponing expired files by %s: %v", runLockRetry, err)
+				postponed = true
+			} else {
+				w.expire(ctx, now)
+				if purge {
+					w.purgeQuarantines(ctx, now)
+					w.nextPurge = now.Add(quarantinePurgeInterval)
+				}
+				runLock.Release()
+			}
+		}
+
+		// Wake up for the next expiry, and regularly to purge quarantines
+		var timer *time.Timer
+		var due <-chan time.Time
+		wait, waiting := time.Duration(0), false
+		if w.stopped == nil && len(w.queue) > 0 {
+			wait, waiting = time.Until(w.queue[0].expiry), true
+		}
+		if quarantined && (!waiting || wait > time.Until(w.nextPurge)) {
+			wait, waiting = time.Until(w.nextPurge), true
+		}
+		if postponed {
+			wait, waiting = runLockRetry, true
+		}
+		if waiting {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			w.Close()
+			w.logger.Printf("Watch mode stopped")
+			closeLogger(w.logger)
+			return
+		case <-reload:
+			if err := w.Load(); err != nil {
+				w.logger.Printf("Error reloading configuration, keeping the previous one: %v", err)
+				fmt.Fprintf(os.Stderr, "Error reloading configuration from %s: %v\n", w.ConfigPath, err)
+			} else {
+				w.logger.Printf("Configuration reloaded")
+			}
+		case batch, ok := <-w.events:
+			if !ok {
+				w.logger.Printf("Error: inotify stopped delivering events")
+				w.events = nil
+				break
+			}
+			for _, event := range batch {
+				w.handleEvent(event)
+			}
+		case <-due:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// runWatch implements the watch command and returns the exit code
+func runWatch(args []string) int {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	w := &Watcher{LockFile: lockFile}
+	flags.StringVar(&w.ConfigPath, "config", configFile, "Configuration file to use")
+	flags.StringVar(&w.Profile, "profile", "", "Apply the named profile from the configuration")
+	flags.BoolVar(&w.DryRun, "dry-run", false, "Run without actually deleting any files")
+	flags.BoolVar(&w.Force, "force", false, "Run even if disabled in the configuration or the mass-deletion guard trips")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if w.ConfigPath == configFile {
+		w.ConfigPath = findConfigFile(w.ConfigPath)
+	}
+
+	if err := w.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration from %s: %v\n", w.ConfigPath, err)
+		return 1
+	}
+
+	// SIGHUP reloads the configuration; SIGTERM and SIGINT stop watching
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan struct{}, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				cancel()
+				return
+			}
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	fmt.Printf("%s watching %d directories (pid %d)\n", ProgramName, len(w.roots), os.Getpid())
+	w.Run(ctx, reload)
+	fmt.Printf("%s stopped watching\n", ProgramName)
+	return 0
+}
+
+// planVersion is the version of the plan file format
+const planVersion = 1
+
+// Plan lists the files a run would delete, for review before ApplyPlan
+// deletes them
+type Plan struct {
+	Version     int              `json:"version"`
+	Created     time.Time        `json:"created"`
+	Config      string           `json:"config"`
+	Profile     string           `json:"profile,omitempty"`
+	Directories []*PlanDirectory `json:"directories"`
+
+	mu sync.Mutex
+}
+
+// PlanDirectory holds the planned files of one directory with the rule that
+// selected them and the security settings to delete them with
+type PlanDirectory struct {
+	Path             string         `json:"path"`
+	Rule             string         `json:"rule"`
+	Security         SecurityConfig `json:"security"`
+	QuarantinePeriod string         `json:"quarantine_period,omitempty"`
+	Files            []PlanFile     `json:"files"`
+}
+
+// PlanFile is a file to delete as it was when planned
+type PlanFile struct {
+	Path    string    `json:"path"`
+	Device  uint64    `json:"device"`
+	Inode   uint64    `json:"inode"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// planKey is the context key of the plan being recorded
+type planKey struct{}
+
+// planRule describes the settings that select the files of a directory entry
+func planRule(dirConfig DirectoryConfig) string {
+	rule := "retention_period " + dirConfig.RetentionPeriod
+	if dirConfig.FilePattern != "" {
+		rule += ", file_pattern " + dirConfig.FilePattern
+	}
+	if dirConfig.ExcludeSubdirs {
+		rule += ", exclude_subdirs"
+	}
+	return rule
+}
 
-		if err := filepath.Walk(dirConfig.Path, walkDirsFn); err != nil {
-			return err
+// newPlanFile records a file as found during the walk
+func newPlanFile(path string, info os.FileInfo) PlanFile {
+	key := inodeKeyOf(info)
+	return PlanFile{Path: path, Device: key.dev, Inode: key.ino, Size: info.Size(), ModTime: info.ModTime()}
+}
+
+// add adds a directory with planned files to the plan
+func (p *Plan) add(dir *PlanDirectory) {
+	if len(dir.Files) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Directories = append(p.Directories, dir)
+}
+
+// MakePlan records the files a run of config would delete without deleting
+// anything. Directories that fail are left out of the plan and reported in
+// the returned error.
+func MakePlan(ctx context.Context, config Config, logger *log.Logger) (*Plan, error) {
+	plan := &Plan{Version: planVersion, Created: time.Now()}
+	err := RunDirectories(context.WithValue(ctx, planKey{}, plan), config, logger)
+
+	// Directories finish in any order when processed in parallel
+	sort.Slice(plan.Directories, func(i, j int) bool {
+		return plan.Directories[i].Path < plan.Directories[j].Path
+	})
+	return plan, err
+}
+
+// ApplyResult counts what happened to the files of a plan
+type ApplyResult struct {
+	Deleted int // deleted, or would be in dry-run mode
+	Refused int // changed since planning, or could not be deleted
+	Missing int // already gone
+}
+
+// ApplyPlan deletes the files of a plan that are unchanged since planning.
+// A file whose inode, modification time or size differs is refused, as is
+// every file of a directory that now resolves elsewhere. As the plan file may
+// be stale or edited, files must also still be below a directory entry of
+// config and not be protected.
+func ApplyPlan(ctx context.Context, plan *Plan, config Config, dryRun bool, logger *log.Logger) ApplyResult {
+	var result ApplyResult
+	protected, err := protectedPathList(config)
+	for _, dir := range plan.Directories {
+		if ctx.Err() != nil {
+			break
+		}
+		refuse := func(path, reason string) {
+			logger.Printf("Refusing to delete %s: %s", path, reason)
+			fmt.Fprintf(os.Stderr, "Refusing to delete %s: %s\n", path, reason)
+			result.Refused++
 		}
 
-		// Sort directories by depth (most nested first)
-		for i := len(dirs) - 1; i >= 0; i-- {
-			dir := dirs[i]
+		// The directory must still be configured and not protected
+		var reason string
+		entry, found := planDirectoryEntry(dir.Path, config)
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case !found:
+			reason = fmt.Sprintf("directory %s is not below a directory of the configuration", dir.Path)
+		case !entry.AllowProtectedPath:
+			reason = protectedPath(dir.Path, protected)
+		}
+		if reason != "" {
+			for _, file := range dir.Files {
+				refuse(file.Path, reason)
+			}
+			continue
+		}
 
-			// Skip if we're excluding subdirectories
-			if dirConfig.ExcludeSubdirs && dir != dirConfig.Path {
-				continue
+		// Deletion settings come from the configuration too
+		checked := *dir
+		checked.Files = nil
+		checked.Security, checked.QuarantinePeriod = entry.EffectiveSecurity(config.Security), entry.QuarantinePeriod
+		if checked.Security != dir.Security || checked.QuarantinePeriod != dir.QuarantinePeriod {
+			logger.Printf("Security or quarantine settings of directory %s differ from the plan, using those of the configuration", dir.Path)
+		}
+		for _, file := range dir.Files {
+			if filepath.Clean(file.Path) != file.Path || file.Path == dir.Path || !pathWithin(file.Path, dir.Path) {
+				refuse(file.Path, fmt.Sprintf("it is not inside directory %s", dir.Path))
+			} else if reason := protectedPath(file.Path, protected); reason != "" && !entry.AllowProtectedPath {
+				refuse(file.Path, reason)
+			} else {
+				checked.Files = append(checked.Files, file)
 			}
+		}
+		result.add(applyPlanDirectory(ctx, &checked, dryRun, logger))
+	}
+	return result
+}
 
-			// Check if directory is empty
-			empty, err := isDirEmpty(dir)
+// planDirectoryEntry returns the directory entry of config that path, a
+// resolved directory of a plan, is the same as or inside
+func planDirectoryEntry(path string, config Config) (DirectoryConfig, bool) {
+	for _, dirConfig := range config.Directories {
+		matches, err := expandDirectoryConfig(dirConfig)
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			root, err := filepath.Abs(match.Path)
 			if err != nil {
-				logger.Printf("Error checking if directory %s is empty: %v", dir, err)
 				continue
 			}
-
-			if empty {
-				if securityConfig.DryRun {
-					logger.Printf("Would remove empty directory: %s", dir)
-				} else {
-					originalDir := dir
-					// Obfuscate directory name if enabled
-					if securityConfig.SecureDelete.ObfuscateFilenames {
-						randomName, err := obfuscateDirectoryName(dir, logger)
-						if err != nil {
-							logger.Printf("Error obfuscating directory name %s: %v", dir, err)
-						} else {
-							dir = randomName
-							logger.Printf("Obfuscated directory name to: %s", dir)
-						}
-					}
-
-					if err := os.Remove(dir); err != nil {
-						logger.Printf("Error removing directory %s: %v", originalDir, err)
-					} else {
-						logger.Printf("Removed empty directory: %s", originalDir)
-					}
-				}
+			if resolved, err := filepath.EvalSymlinks(root); err == nil {
+				root = resolved
+			}
+			if pathWithin(path, root) {
+				return match, true
 			}
 		}
 	}
+	return DirectoryConfig{}, false
+}
 
-	return nil
+func (r *ApplyResult) add(other ApplyResult) {
+	r.Deleted += other.Deleted
+	r.Refused += other.Refused
+	r.Missing += other.Missing
 }
 
-// isDirEmpty checks if a directory is empty
-func isDirEmpty(dir string) (bool, error) {
-	f, err := os.Open(dir)
+// applyPlanDirectory applies the planned files of one directory
+func applyPlanDirectory(ctx context.Context, dir *PlanDirectory, dryRun bool, logger *log.Logger) ApplyResult {
+	var result ApplyResult
+	logger.Printf("Applying plan for directory %s (%s): %d files", dir.Path, dir.Rule, len(dir.Files))
+
+	tree, err := openSafeTree(dir.Path)
+	if err == nil && tree.root != dir.Path {
+		err = fmt.Errorf("it now resolves to %s", tree.root)
+	}
 	if err != nil {
-		return false, err
+		logger.Printf("Refusing all %d files of directory %s: %v", len(dir.Files), dir.Path, err)
+		fmt.Fprintf(os.Stderr, "Refusing all %d files of directory %s: %v\n", len(dir.Files), dir.Path, err)
+		tree.Close()
+		result.Refused = len(dir.Files)
+		return result
 	}
-	defer f.Close()
+	defer tree.Close()
 
-	// Try to read just one file
-	_, err = f.Readdirnames(1)
-	if err == nil {
-		// Directory is not empty
-		return false, nil
+	security := dir.Security
+	if dryRun {
+		security.DryRun = true
 	}
-	if err != nil && err.Error() == "EOF" {
-		// Directory is empty
-		return true, nil
+	policy := security.SecureDelete.HardlinkPolicy
+	if policy == "" {
+		policy = HardlinkPolicySkip
 	}
-	return false, err
+	var q *quarantine
+	action := "delete"
+	if dir.QuarantinePeriod != "" {
+		period, err := ParseDuration(dir.QuarantinePeriod)
+		if err != nil {
+			logger.Printf("Refusing all %d files of directory %s: invalid quarantine period '%s': %v", len(dir.Files), dir.Path, dir.QuarantinePeriod, err)
+			result.Refused = len(dir.Files)
+			return result
+		}
+		q, action = newQuarantine(tree, period), "quarantine"
+	}
+
+	// Hard-linked files are handled together after the others, as in a run
+	hardlinks := make(map[inodeKey]*hardlinkGroup)
+	var hardlinkOrder []inodeKey
+
+	for _, file := range dir.Files {
+		if ctx.Err() != nil {
+			logger.Printf("Stopped applying plan for directory %s (%v)", dir.Path, context.Cause(ctx))
+			break
+		}
+
+		info, err := os.Lstat(file.Path)
+		if os.IsNotExist(err) {
+			logger.Printf("File %s no longer exists", file.Path)
+			result.Missing++
+			continue
+		}
+		var changed string
+		if err != nil {
+			changed = err.Error()
+		} else if key := inodeKeyOf(info); key.dev != file.Device || key.ino != file.Inode {
+			changed = "it is a different file (inode changed) since planning"
+		} else if !info.ModTime().Equal(file.ModTime) {
+			changed = "it was modified since planning"
+		} else if info.Size() != file.Size {
+			changed = "its size changed since planning"
+		}
+		if changed != "" {
+			logger.Printf("Refusing to delete %s: %s", file.Path, changed)
+			fmt.Fprintf(os.Stderr, "Refusing to delete %s: %s\n", file.Path, changed)
+			result.Refused++
+			continue
+		}
+
+		if security.DryRun {
+			logger.Printf("Would %s file: %s (modified: %s)", action, file.Path, info.ModTime().Format(time.RFC3339))
+			fmt.Printf("Would %s file: %s (modified: %s)\n", action, file.Path, info.ModTime().Format(time.RFC3339))
+			result.Deleted++
+			continue
+		}
+		if q != nil {
+			q.add(file.Path, logger)
+			result.add(deletionResult(file.Path))
+			continue
+		}
+
+		if nlink := linkCount(info); security.SecureDelete.Enabled && nlink > 1 {
+			key := inodeKeyOf(info)
+			group, ok := hardlinks[key]
+			if !ok {
+				group = &hardlinkGroup{nlink: nlink}
+				hardlinks[key] = group
+				hardlinkOrder = append(hardlinkOrder, key)
+			}
+			group.paths = append(group.paths, file.Path)
+			continue
+		}
+		deleteFile(ctx, tree, file.Path, security, logger)
+		result.add(deletionResult(file.Path))
+	}
+
+	for _, key := range hardlinkOrder {
+		group := hardlinks[key]
+		deleteHardlinkGroup(ctx, tree, group, policy, security, logger)
+		for _, path := range group.paths {
+			result.add(deletionResult(path))
+		}
+	}
+
+	return result
 }
 
-// secureDeleteFile performs secure deletion of a file by overwriting with random data
-func secureDeleteFile(path string, passes int, logger *log.Logger) error {
-	// Open the file for writing
-	file, err := os.OpenFile(path, os.O_WRONLY, 0)
-	if err != nil {
-		return err
+// deletionResult counts a file as deleted if it is gone, refused otherwise
+func deletionResult(path string) ApplyResult {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return ApplyResult{Deleted: 1}
 	}
-	defer file.Close()
+	return ApplyResult{Refused: 1}
+}
 
-	// Get file info for size
-	info, err := file.Stat()
+// runPlan implements the plan command and returns the exit code
+func runPlan(args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "Configuration file to use")
+	profile := flags.String("profile", "", "Apply the named profile from the configuration")
+	out := flags.String("out", "-", "File to write the plan to (- for standard output)")
+	force := flags.Bool("force", false, "Plan even if the mass-deletion guard trips")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path := *configPath
+	if path == configFile {
+		path = findConfigFile(path)
+	}
+	config, err := LoadConfigProfile(path, *profile)
 	if err != nil {
-		return err
+		fmt.Fprintf(os.Stderr, "Error loading configuration from %s: %v\n", path, err)
+		return 1
+	}
+	if *force {
+		applyForce(&config)
 	}
+	logger, err := setupLogger(config.General.Logging)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up logger: %v\n", err)
+		return 1
+	}
+	defer closeLogger(logger)
 
-	// Create a buffer for overwriting
-	size := info.Size()
-	buf := make([]byte, 8192) // Use a reasonable buffer size
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Perform the secure deletion passes
-	for pass := 0; pass < passes; pass++ {
-		logger.Printf("Secure delete pass %d/%d for %s", pass+1, passes, path)
+	logger.Printf("Planning deletions from %s", path)
+	plan, planErr := MakePlan(ctx, config, logger)
+	plan.Config, plan.Profile = path, *profile
+	if abs, err := filepath.Abs(path); err == nil {
+		plan.Config = abs
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Stopped by signal, no plan written: %v\n", planErr)
+		return 1
+	}
 
-		// Reset to beginning of file
-		if _, err := file.Seek(0, 0); err != nil {
-			return err
-		}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding plan: %v\n", err)
+		return 1
+	}
+	data = append(data, '\n')
+	if *out == "-" {
+		os.Stdout.Write(data)
+	} else if err := writeFileAtomic(*out, data, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing plan: %v\n", err)
+		return 1
+	}
 
-		// Fill the buffer with random data for this pass
-		for i := range buf {
-			buf[i] = byte(pass ^ i)
+	var files int
+	var size int64
+	for _, dir := range plan.Directories {
+		files += len(dir.Files)
+		for _, file := range dir.Files {
+			size += file.Size
 		}
+	}
+	logger.Printf("Planned deletion of %d files (%d bytes) in %d directories", files, size, len(plan.Directories))
+	if *out != "-" {
+		fmt.Printf("Planned deletion of %d files (%d bytes) in %d directories, written to %s\n", files, size, len(plan.Directories), *out)
+	}
+	if planErr != nil {
+		fmt.Fprintf(os.Stderr, "Plan is incomplete: %v\n", planErr)
+		return 1
+	}
+	return 0
+}
 
-		// Write the random data to the file
-		remaining := size
-		for remaining > 0 {
-			writeSize := int64(len(buf))
-			if remaining < writeSize {
-				writeSize = remaining
-			}
+// runApply implements the apply command and returns the exit code
+func runApply(args []string) int {
+	flags := flag.NewFlagSet("apply", flag.ContinueOnError)
+	configPath := flags.String("config", "", "Configuration file to check the plan against and log with (default: the one the plan was made from)")
+	dryRun := flags.Bool("dry-run", false, "Check the plan without deleting any files")
+	wait := flags.Bool("wait", false, "Wait for another run to finish instead of exiting")
+	noWait := flags.Bool("no-wait", false, "Exit if another run is in progress (default)")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if *wait && *noWait {
+		fmt.Fprintln(os.Stderr, "Error: --wait and --no-wait cannot be used together")
+		return 2
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: filekeeper apply [--config PATH] [--dry-run] [--wait] PLAN")
+		return 2
+	}
 
-			if _, err := file.Write(buf[:writeSize]); err != nil {
-				return err
-			}
+	data, err := os.ReadFile(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading plan: %v\n", err)
+		return 1
+	}
+	plan := &Plan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading plan %s: %v\n", positional[0], err)
+		return 1
+	}
+	if plan.Version != planVersion {
+		fmt.Fprintf(os.Stderr, "Error reading plan %s: unsupported plan version %d (expected %d)\n", positional[0], plan.Version, planVersion)
+		return 1
+	}
 
-			remaining -= writeSize
-		}
+	path := *configPath
+	if path == "" {
+		path = plan.Config
+	}
+	config, err := LoadConfigProfile(path, plan.Profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration from %s: %v\n", path, err)
+		return 1
+	}
+	logger, err := setupLogger(config.General.Logging)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up logger: %v\n", err)
+		return 1
+	}
+	defer closeLogger(logger)
 
-		// Flush to disk
-		if err := file.Sync(); err != nil {
-			return err
-		}
+	runLock, err := AcquireRunLock(lockFile, *wait)
+	if err != nil {
+		logger.Printf("Error: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
 	}
+	defer runLock.Release()
 
-	// Final deletion
-	return os.Remove(path)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger.Printf("Applying plan %s created %s", positional[0], plan.Created.Format(time.RFC3339))
+	result := ApplyPlan(ctx, plan, config, *dryRun, logger)
+	summary := fmt.Sprintf("%d files deleted, %d refused, %d already gone", result.Deleted, result.Refused, result.Missing)
+	if *dryRun {
+		summary = fmt.Sprintf("%d files would be deleted, %d refused, %d already gone", result.Deleted, result.Refused, result.Missing)
+	}
+	logger.Printf("Finished applying plan: %s", summary)
+	fmt.Printf("Finished applying plan: %s\n", summary)
+
+	if ctx.Err() != nil || result.Refused > 0 {
+		return 1
+	}
+	return 0
 }
 
 // setupLogger sets up the logger based on configuration
@@ -662,6 +5916,12 @@ func setupLogger(config LoggingConfig) (*log.Logger, error) {
 		// If logging is disabled, use a no-op logger
 		return log.New(io.Discard, "", 0), nil
 	}
+	// An unknown level is reported by validate; running configurations keep
+	// logging at the default level
+	level, levelErr := parseLoggingLevel(config.Level)
+	if levelErr != nil {
+		level = "info"
+	}
 
 	// Ensure the log directory exists
 	logDir := filepath.Dir(config.File)
@@ -677,14 +5937,157 @@ func setupLogger(config LoggingConfig) (*log.Logger, error) {
 
 	// Set up logger
 	var logFlags int
-	switch strings.ToLower(config.Level) {
+	switch level {
 	case "debug":
 		logFlags = log.Ldate | log.Ltime | log.Lshortfile
 	default:
 		logFlags = log.Ldate | log.Ltime
 	}
 
-	return log.New(logFile, "", logFlags), nil
+	logger := log.New(logFile, "", logFlags)
+	if levelErr != nil {
+		logger.Printf("Warning: %v, logging at level %s", levelErr, level)
+	}
+	return logger, nil
+}
+
+// runRestore implements the restore subcommand, which lists quarantined files
+// or moves them back to where they were
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	configPath := flags.String("config", configFile, "Configuration file to use")
+	profile := flags.String("profile", "", "Apply the named profile from the configuration")
+	list := flags.Bool("list", false, "List the quarantined files instead of restoring")
+	dryRun := flags.Bool("dry-run", false, "Show what would be restored without moving any files")
+	touch := flags.Bool("touch", false, "Set the modification time of restored files to now, so they are not quarantined again")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+
+	path := *configPath
+	if path == configFile {
+		path = findConfigFile(path)
+	}
+	config, err := LoadConfigProfile(path, *profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration from %s: %v\n", path, err)
+		return 1
+	}
+	logger, err := setupLogger(config.General.Logging)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up logger: %v\n", err)
+		return 1
+	}
+	defer closeLogger(logger)
+
+	// Collect the quarantines of all directories, whether or not quarantine
+	// is still configured for them
+	type quarantined struct {
+		q    *quarantine
+		file quarantinedFile
+	}
+	var files []quarantined
+	seen := make(map[string]bool)
+	for _, dirConfig := range config.Directories {
+		matches, err := expandDirectoryConfig(dirConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: directory %s: %v\n", dirConfig.Path, err)
+			return 1
+		}
+		for _, match := range matches {
+			tree, err := openSafeTree(match.Path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening directory %s: %v\n", match.Path, err)
+				return 1
+			}
+			defer tree.Close()
+			if seen[tree.root] {
+				continue
+			}
+			seen[tree.root] = true
+
+			q := newQuarantine(tree, 0)
+			found, err := q.list()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading quarantine %s: %v\n", q.dir, err)
+				return 1
+			}
+			for _, file := range found {
+				files = append(files, quarantined{q: q, file: file})
+			}
+		}
+	}
+
+	if *list || len(positional) == 0 {
+		if len(files) == 0 {
+			fmt.Println("No quarantined files")
+			return 0
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "QUARANTINED\tPATH")
+		for _, f := range files {
+			fmt.Fprintf(writer, "%s\t%s\n", f.file.Quarantined.Local().Format(time.RFC3339), f.file.Path)
+		}
+		writer.Flush()
+		return 0
+	}
+
+	runLock, err := AcquireRunLock(lockFile, false)
+	if err != nil {
+		logger.Printf("Error: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer runLock.Release()
+
+	// Restore the most recently quarantined version of each matching file;
+	// list returns the oldest batches first
+	failed := 0
+	for _, arg := range positional {
+		target, err := filepath.Abs(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", arg, err)
+			failed++
+			continue
+		}
+		latest := make(map[string]quarantined)
+		var order []string
+		for _, f := range files {
+			if f.file.Path != target && !strings.HasPrefix(f.file.Path, target+string(filepath.Separator)) {
+				continue
+			}
+			if _, ok := latest[f.file.Path]; !ok {
+				order = append(order, f.file.Path)
+			}
+			latest[f.file.Path] = f
+		}
+		if len(order) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: nothing quarantined at %s\n", target)
+			failed++
+			continue
+		}
+		for _, original := range order {
+			f := latest[original]
+			if *dryRun {
+				fmt.Printf("Would restore %s (quarantined %s)\n", original, f.file.Quarantined.Local().Format(time.RFC3339))
+				continue
+			}
+			if err := f.q.restore(f.file, *touch); err != nil {
+				logger.Printf("Error restoring %s: %v", original, err)
+				fmt.Fprintf(os.Stderr, "Error restoring %s: %v\n", original, err)
+				failed++
+				continue
+			}
+			logger.Printf("Restored file: %s", original)
+			fmt.Printf("Restored %s\n", original)
+		}
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
 }
 
 // PrintHelp prints the help information
@@ -692,32 +6095,88 @@ func PrintHelp() {
 	fmt.Printf("%s v%s - A program to remove files older than a specified retention period\n\n", ProgramName, ProgramVersion)
 	fmt.Println("Usage:")
 	fmt.Println("  filekeeper [options]")
+	fmt.Println("  filekeeper validate [--config PATH]")
+	fmt.Println("  filekeeper config migrate [--config PATH]")
+	fmt.Println("  filekeeper config schema")
+	fmt.Println("  filekeeper dir list|add|remove|set [--config PATH] ...")
+	fmt.Println("  filekeeper daemon [--config PATH] [--profile NAME] [--dry-run] [--force]")
+	fmt.Println("  filekeeper watch [--config PATH] [--profile NAME] [--dry-run] [--force]")
+	fmt.Println("  filekeeper plan [--config PATH] [--profile NAME] [--out FILE] [--force]")
+	fmt.Println("  filekeeper apply [--config PATH] [--dry-run] [--wait] PLAN")
+	fmt.Println("  filekeeper restore [--config PATH] [--list] [--dry-run] [--touch] [PATH...]")
+	fmt.Println("\nCommands:")
+	fmt.Println("  validate                Strictly check the configuration and report all problems")
+	fmt.Println("  config migrate          Rewrite the configuration in the current schema version")
+	fmt.Println("  config schema           Print a JSON Schema of the configuration file")
+	fmt.Println("  dir list                List the directories in the configuration file")
+	fmt.Println("  dir add PATH            Add a directory (--retention, --pattern, --exclude-subdirs, --remove-empty-dirs)")
+	fmt.Println("  dir remove PATH         Remove a directory")
+	fmt.Println("  dir set PATH KEY VALUE  Change a setting of a directory")
+	fmt.Println("  daemon                  Stay resident and run each directory on its schedule")
+	fmt.Println("  watch                   Stay resident and remove files as soon as they expire")
+	fmt.Println("  plan                    Record the files a run would delete in a plan file")
+	fmt.Println("  apply PLAN              Delete the files of a plan that are unchanged since planning")
+	fmt.Println("  restore PATH...         Move quarantined files back (all files below a directory PATH)")
 	fmt.Println("\nOptions:")
 	fmt.Println("  --help                  Show this help message")
 	fmt.Println("  --version               Show version information")
 	fmt.Println("  --init                  Create a default configuration file")
 	fmt.Println("  --config PATH           Specify an alternative configuration file path")
+	fmt.Println("  --format FORMAT         Format of the file created by --init (yaml, json, toml)")
 	fmt.Println("  --install-systemd       Create systemd service and timer files")
 	fmt.Println("  --systemd-template-only Output systemd templates without creating files")
 	fmt.Println("  --dry-run               Run without actually deleting any files")
-	fmt.Println("  --force                 Run even if disabled in the configuration")
+	fmt.Println("  --force                 Run even if disabled or the mass-deletion guard trips")
+	fmt.Println("  --profile NAME          Apply the named profile from the configuration")
+	fmt.Println("  --print-effective-config Print the merged configuration and exit")
+	fmt.Println("  --wait                  Wait for another run to finish instead of exiting")
+	fmt.Println("  --no-wait               Exit if another run is in progress (default)")
 
 	fmt.Println("\nDefault configuration paths:")
 	if isRoot {
 		fmt.Println("  - System config (root): /etc/filekeeper/filekeeper.yaml")
+		fmt.Println("  - Drop-in files: /etc/filekeeper/conf.d/*.yaml")
+		fmt.Println("  - Run lock: /run/filekeeper.lock")
 	} else {
 		homeDir, _ := os.UserHomeDir()
 		fmt.Println("  - User config: " + filepath.Join(homeDir, ".config", "filekeeper.yaml"))
+		fmt.Println("  - Drop-in files: " + filepath.Join(homeDir, ".config", "filekeeper.d", "*.yaml"))
+		fmt.Println("  - Run lock: " + filepath.Join(homeDir, ".config", "filekeeper.lock"))
 	}
 
 	fmt.Println("\nExamples:")
 	fmt.Println("  filekeeper --init                   # Create default configuration")
 	fmt.Println("  filekeeper                          # Run with default configuration")
 	fmt.Println("  filekeeper --dry-run                # Simulate deletion without removing files")
+	fmt.Println("  filekeeper --profile aggressive     # Run with the 'aggressive' profile")
 	fmt.Println("  filekeeper --install-systemd        # Install systemd service and timer")
+	fmt.Println("  filekeeper validate                 # Check the configuration for mistakes")
+	fmt.Println("  filekeeper dir add /tmp/spool --retention 7d # Add a directory to the configuration")
 }
 
 func main() {
+	// Run subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		case "dir":
+			os.Exit(runDir(os.Args[2:]))
+		case "daemon":
+			os.Exit(runDaemon(os.Args[2:]))
+		case "watch":
+			os.Exit(runWatch(os.Args[2:]))
+		case "plan":
+			os.Exit(runPlan(os.Args[2:]))
+		case "apply":
+			os.Exit(runApply(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		}
+	}
+
 	// Parse command line flags
 	var (
 		showHelp            bool
@@ -728,6 +6187,11 @@ func main() {
 		systemdTemplateOnly bool
 		dryRun              bool
 		force               bool
+		printEffective      bool
+		profile             string
+		format              string
+		wait                bool
+		noWait              bool
 	)
 
 	flag.BoolVar(&showHelp, "help", false, "Show help information")
@@ -737,7 +6201,12 @@ func main() {
 	flag.BoolVar(&installSystemd, "install-systemd", false, "Create systemd service and timer files")
 	flag.BoolVar(&systemdTemplateOnly, "systemd-template-only", false, "Output systemd templates without creating files")
 	flag.BoolVar(&dryRun, "dry-run", false, "Run without actually deleting any files")
-	flag.BoolVar(&force, "force", false, "Run even if disabled in the configuration")
+	flag.BoolVar(&force, "force", false, "Run even if disabled in the configuration or the mass-deletion guard trips")
+	flag.BoolVar(&printEffective, "print-effective-config", false, "Print the merged configuration and exit")
+	flag.StringVar(&profile, "profile", "", "Apply the named profile from the configuration")
+	flag.StringVar(&format, "format", FormatYAML, "Format of the configuration created by --init (yaml, json, toml)")
+	flag.BoolVar(&wait, "wait", false, "Wait for another run to finish instead of exiting")
+	flag.BoolVar(&noWait, "no-wait", false, "Exit if another run is in progress (default)")
 
 	flag.Parse()
 
@@ -750,7 +6219,7 @@ func main() {
 
 	// If no arguments and config doesn't exist, show help
 	if len(os.Args) == 1 {
-		_, err := os.Stat(configFile)
+		_, err := os.Stat(findConfigFile(configFile))
 		if os.IsNotExist(err) {
 			PrintHelp()
 			fmt.Println("\nRun 'filekeeper --init' to create a default configuration file.")
@@ -767,8 +6236,11 @@ func main() {
 
 	// Initialize configuration
 	if initConfig {
+		if format != FormatYAML {
+			configPath = strings.TrimSuffix(configPath, filepath.Ext(configPath)) + "." + format
+		}
 		exampleConfigPath := configPath + ".example"
-		if err := WriteExampleConfig(exampleConfigPath); err != nil {
+		if err := WriteExampleConfigFormat(exampleConfigPath, format); err != nil {
 			fmt.Fprintf(os.Stderr, "Error creating example configuration: %v\n", err)
 			os.Exit(1)
 		}
@@ -793,14 +6265,28 @@ func main() {
 		return
 	}
 
+	// The default configuration may be in any supported format
+	if configPath == configFile {
+		configPath = findConfigFile(configPath)
+	}
+
 	// Try to load configuration
-	config, err := LoadConfig(configPath)
+	config, err := LoadConfigProfile(configPath, profile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading configuration from %s: %v\n", configPath, err)
 		fmt.Println("Run 'filekeeper --init' to create a default configuration file.")
 		os.Exit(1)
 	}
 
+	// Print the merged configuration
+	if printEffective {
+		if err := PrintEffectiveConfig(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error printing configuration: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Check if program is enabled
 	if !config.General.Enabled && !force {
 		fmt.Println("Program is disabled in configuration. Use --force to run anyway.")
@@ -814,25 +6300,75 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Report older configuration layouts that were upgraded in memory
+	for _, warning := range config.Warnings {
+		logger.Printf("Warning: %s", warning)
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	if len(config.Warnings) > 0 && isDefaultConfig(configPath) {
+		fmt.Fprintln(os.Stderr, "Run 'filekeeper config migrate' to update the configuration files.")
+	} else if len(config.Warnings) > 0 {
+		fmt.Fprintf(os.Stderr, "Run 'filekeeper config migrate --config %s' to update the configuration files.\n", configPath)
+	}
+
 	// Override dry run if specified in command line
 	if dryRun {
-		config.Security.DryRun = true
+		applyDryRun(&config)
+	}
+	if force {
+		applyForce(&config)
+	}
+
+	// Only one run at a time may walk and delete
+	if wait && noWait {
+		fmt.Fprintln(os.Stderr, "Error: --wait and --no-wait cannot be used together")
+		os.Exit(2)
 	}
+	runLock, err := AcquireRunLock(lockFile, wait)
+	if err != nil {
+		logger.Printf("Error: %v", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer runLock.Release()
 
 	// Log startup
 	logger.Printf("Starting %s v%s", ProgramName, ProgramVersion)
 	logger.Printf("Configuration loaded from: %s", configPath)
+	if profile != "" {
+		logger.Printf("Using profile: %s", profile)
+	}
 	if config.Security.DryRun {
 		logger.Printf("Running in dry-run mode - no files will be deleted")
 		fmt.Println("Running in dry-run mode - no files will be deleted")
 	}
 
+	// SIGINT and SIGTERM stop the run after the files being deleted; a second
+	// signal terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	// Process each directory
-	for _, dirConfig := range config.Directories {
-		if err := ProcessDirectory(dirConfig, config.Security, logger); err != nil {
-			logger.Printf("Error processing directory %s: %v", dirConfig.Path, err)
-			fmt.Fprintf(os.Stderr, "Error processing directory %s: %v\n", dirConfig.Path, err)
+	if err := RunDirectories(ctx, config, logger); err != nil {
+		if ctx.Err() != nil {
+			logger.Printf("Stopped by signal, %v", err)
+			fmt.Fprintf(os.Stderr, "Stopped by signal, %v\n", err)
+			runLock.Release()
+			os.Exit(1)
+		}
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			logger.Printf("Stopped at a limit, %v", err)
+			fmt.Fprintf(os.Stderr, "Stopped at a limit, %v\n", err)
+			runLock.Release()
+			os.Exit(1)
 		}
+		logger.Printf("Finished processing all directories: %v", err)
+		return
 	}
 
 	logger.Printf("Finished processing all directories")
@@ -2,17 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // TestParseDuration tests the ParseDuration function
@@ -55,6 +65,123 @@ func TestParseDuration(t *testing.T) {
 	}
 }
 
+// TestParseSize tests the ParseSize function
+func TestParseSize(t *testing.T) {
+	// Positive tests
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512B", 512},
+		{"64K", 64 << 10},
+		{"50MB", 50 << 20},
+		{"1GiB", 1 << 30},
+		{"2T", 2 << 40},
+		{"10 mb", 10 << 20},
+		{"8388607T", 8388607 << 40},
+		{"9223372036854775807", math.MaxInt64},
+	}
+
+	for _, test := range tests {
+		result, err := ParseSize(test.input)
+		if err != nil {
+			t.Errorf("ParseSize(%s) returned error: %v", test.input, err)
+		}
+		if result != test.expected {
+			t.Errorf("ParseSize(%s) = %d, want %d", test.input, result, test.expected)
+		}
+	}
+
+	// Negative tests
+	invalidTests := []string{
+		"",             // Empty string
+		"MB",           // No numeric part
+		"10XB",         // Invalid unit
+		"-1K",          // Negative size
+		"8388608T",     // Overflows int64
+		"99999999999T", // Overflows int64
+	}
+
+	for _, test := range invalidTests {
+		_, err := ParseSize(test)
+		if err == nil {
+			t.Errorf("ParseSize(%s) did not return error for invalid input", test)
+		}
+	}
+}
+
+// TestParseSchedule tests the ParseSchedule function
+func TestParseSchedule(t *testing.T) {
+	base := time.Date(2024, time.January, 15, 10, 30, 0, 0, time.UTC) // A Monday
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"6h", base.Add(6 * time.Hour)},
+		{"@every 30m", base.Add(30 * time.Minute)},
+		{"1d", base.Add(24 * time.Hour)},
+		{"* * * * *", base.Add(time.Minute)},
+		{"0 3 * * *", time.Date(2024, time.January, 16, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, time.January, 15, 13, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.January, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.January, 16, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, time.January, 21, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * sat,7", time.Date(2024, time.January, 20, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either one matches
+		{"0 0 20 * mon", time.Date(2024, time.January, 20, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("ParseSchedule(%s) returned error: %v", test.spec, err)
+			continue
+		}
+		if next := schedule.Next(base); !next.Equal(test.expected) {
+			t.Errorf("ParseSchedule(%s).Next() = %s, want %s", test.spec, next, test.expected)
+		}
+	}
+
+	// A date that never occurs has no next run
+	schedule, err := ParseSchedule("0 0 30 2 *")
+	if err != nil {
+		t.Fatalf("ParseSchedule returned error: %v", err)
+	}
+	if next := schedule.Next(base); !next.IsZero() {
+		t.Errorf("Schedule for February 30 returned %s", next)
+	}
+
+	// Negative tests
+	invalidTests := []string{
+		"",            // Empty string
+		"0s",          // Zero interval
+		"@every",      // Missing interval
+		"@sometimes",  // Unknown shorthand
+		"* * * *",     // Too few fields
+		"60 * * * *",  // Minute out of range
+		"* 24 * * *",  // Hour out of range
+		"* * 0 * *",   // Day of month out of range
+		"* * * foo *", // Unknown month
+		"*/0 * * * *", // Zero step
+		"5-1 * * * *", // Reversed range
+		"* * * * * *", // Too many fields
+		"1x",          // Invalid interval
+	}
+
+	for _, test := range invalidTests {
+		if _, err := ParseSchedule(test); err == nil {
+			t.Errorf("ParseSchedule(%s) did not return error for invalid input", test)
+		}
+	}
+}
+
 // TestIsDirEmpty tests the isDirEmpty function
 func TestIsDirEmpty(t *testing.T) {
 	// Create a temporary directory for testing
@@ -242,310 +369,3187 @@ security:
 	}
 }
 
-// TestObfuscateFilename tests the obfuscateFilename function
-func TestObfuscateFilename(t *testing.T) {
-	// Create a temporary directory for testing
-	tempDir, err := os.MkdirTemp("", "filekeeper-obfuscate-test")
+// oldTestTime is the modification time of expired test files
+var oldTestTime = time.Now().Add(-10 * 24 * time.Hour)
+
+// writeTestFile creates a file with content, creating its parent directories
+func writeTestFile(t *testing.T, path, content string) string {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file %s: %v", path, err)
+	}
+	return path
+}
+
+// writeOldFile creates a file that was last modified ten days ago
+func writeOldFile(t *testing.T, path string) string {
+	t.Helper()
+	writeTestFile(t, path, "test content")
+	if err := os.Chtimes(path, oldTestTime, oldTestTime); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+	return path
+}
+
+// fillTestDir creates old and then recent files file0.log, file1.log, ...
+// holding content in dir
+func fillTestDir(t *testing.T, dir string, old, recent int, content string) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for i := 0; i < old+recent; i++ {
+		path := writeTestFile(t, filepath.Join(dir, fmt.Sprintf("file%d.log", i)), content)
+		if i < old {
+			if err := os.Chtimes(path, oldTestTime, oldTestTime); err != nil {
+				t.Fatalf("Failed to set file time: %v", err)
+			}
+		}
+	}
+	return dir
+}
+
+// countEntries returns the number of entries in dir
+func countEntries(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	return len(entries)
+}
+
+// waitRemoved waits up to three seconds for path to disappear
+func waitRemoved(path string) bool {
+	for i := 0; i < 150; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+// TestConfigIncludes tests merging of included and drop-in configuration files
+func TestConfigIncludes(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "filekeeper-include-test")
 	if err != nil {
 		t.Fatalf("Failed to create temp directory: %v", err)
 	}
 	defer os.RemoveAll(tempDir)
 
-	// Create a test file
-	testFilePath := filepath.Join(tempDir, "test-file.txt")
-	if err := os.WriteFile(testFilePath, []byte("test content"), 0644); err != nil {
-		t.Fatalf("Failed to create test file: %v", err)
+	mainConfig := writeTestFile(t, filepath.Join(tempDir, "filekeeper.yaml"), `include:
+  - apps/*.yaml
+general:
+  enabled: true
+  logging:
+    level: "info"
+directories:
+  - path: "/tmp/main"
+    retention_period: "30d"
+security:
+  dry_run: true
+`)
+	writeTestFile(t, filepath.Join(tempDir, "apps/a.yaml"), `directories:
+  - path: "/tmp/app-a"
+    retention_period: "7d"
+`)
+	writeTestFile(t, filepath.Join(tempDir, "apps/b.yaml"), `general:
+  logging:
+    level: "info"
+directories:
+  - path: "/tmp/app-b"
+    retention_period: "1d"
+`)
+
+	// Includes are merged and directory lists concatenated
+	config, err := LoadConfig(mainConfig)
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	var paths []string
+	for _, dir := range config.Directories {
+		paths = append(paths, dir.Path)
+	}
+	if got := strings.Join(paths, ","); got != "/tmp/main,/tmp/app-a,/tmp/app-b" {
+		t.Errorf("Merged directories = %s, want /tmp/main,/tmp/app-a,/tmp/app-b", got)
+	}
+	if !config.Security.DryRun || config.General.Logging.Level != "info" {
+		t.Error("Merged config lost scalar settings from the main file")
 	}
 
-	// Create a test logger
-	logger := log.New(io.Discard, "", 0)
+	// Conflicting scalar settings name both files
+	conflicting := writeTestFile(t, filepath.Join(tempDir, "apps/c.yaml"), `security:
+  dry_run: false
+`)
+	_, err = LoadConfig(mainConfig)
+	if err == nil {
+		t.Fatal("LoadConfig() did not return error for conflicting settings")
+	}
+	for _, name := range []string{mainConfig, conflicting, "security.dry_run"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Conflict error %q does not mention %s", err, name)
+		}
+	}
+	os.Remove(conflicting)
 
-	// Test obfuscating a file name
-	newPath, err := obfuscateFilename(testFilePath, logger)
-	if err != nil {
-		t.Errorf("obfuscateFilename returned error: %v", err)
+	// Include cycles are detected
+	cycleA := writeTestFile(t, filepath.Join(tempDir, "cycle/a.yaml"), "include: [b.yaml]\n")
+	writeTestFile(t, filepath.Join(tempDir, "cycle/b.yaml"), "include: [a.yaml]\n")
+	if _, err := LoadConfig(cycleA); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("LoadConfig() did not report include cycle, got: %v", err)
 	}
 
-	// Verify the result
-	if newPath == testFilePath {
-		t.Error("obfuscateFilename didn't change the file path")
+	// Missing include files are reported
+	missing := writeTestFile(t, filepath.Join(tempDir, "missing.yaml"), "include: [does-not-exist.yaml]\n")
+	if _, err := LoadConfig(missing); err == nil {
+		t.Error("LoadConfig() did not return error for missing include")
 	}
 
-	// Check that the original file doesn't exist anymore
-	if _, err := os.Stat(testFilePath); !os.IsNotExist(err) {
-		t.Error("Original file still exists after obfuscation")
+	// Drop-in directory is read for the default configuration file
+	origConfigFile, origDropInDir := configFile, dropInDir
+	defer func() { configFile, dropInDir = origConfigFile, origDropInDir }()
+
+	configFile = mainConfig
+	dropInDir = filepath.Join(tempDir, "conf.d")
+	writeTestFile(t, filepath.Join(tempDir, "conf.d/10-spool.yaml"), `directories:
+  - path: "/tmp/spool"
+    retention_period: "2h"
+`)
+	config, err = LoadConfig(mainConfig)
+	if err != nil {
+		t.Fatalf("LoadConfig() with drop-in directory returned error: %v", err)
+	}
+	if len(config.Directories) != 4 || config.Directories[3].Path != "/tmp/spool" {
+		t.Errorf("Drop-in directory was not merged, got %d directories", len(config.Directories))
 	}
 
-	// Check that the new file exists
-	if _, err := os.Stat(newPath); os.IsNotExist(err) {
-		t.Error("Obfuscated file doesn't exist")
+	// Drop-ins are not read for other configuration files
+	other := writeTestFile(t, filepath.Join(tempDir, "other.yaml"), "directories: []\n")
+	config, err = LoadConfig(other)
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
 	}
+	if len(config.Directories) != 0 {
+		t.Error("Drop-in directory was merged into a non-default configuration file")
+	}
+}
 
-	// Verify the extension was changed (no longer preserving original extension)
-	if filepath.Ext(newPath) == ".txt" {
-		t.Errorf("File extension was not obfuscated, still has original extension: %s", filepath.Ext(newPath))
+// TestConfigDefaults tests inheritance of the defaults section by directory entries
+func TestConfigDefaults(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "filekeeper-defaults-*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
 	}
+	defer os.Remove(tempFile.Name())
 
-	// Verify the new extension exists and starts with a dot
-	ext := filepath.Ext(newPath)
-	if ext == "" || ext[0] != '.' {
-		t.Errorf("New file has invalid extension format: %s", ext)
+	testConfig := `defaults:
+  retention_period: "30d"
+  file_pattern: "*.log"
+  remove_empty_dirs: true
+directories:
+  - path: "/tmp/inherits"
+  - path: "/tmp/overrides"
+    retention_period: "7d"
+    file_pattern: "*.tmp"
+    remove_empty_dirs: false
+`
+	if _, err := tempFile.Write([]byte(testConfig)); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
 	}
+	tempFile.Close()
 
-	// Verify the file content
-	content, err := os.ReadFile(newPath)
+	config, err := LoadConfig(tempFile.Name())
 	if err != nil {
-		t.Errorf("Failed to read obfuscated file: %v", err)
+		t.Fatalf("LoadConfig() returned error: %v", err)
 	}
-	if string(content) != "test content" {
-		t.Errorf("File content changed after obfuscation, got %s, want 'test content'", string(content))
+	if len(config.Directories) != 2 {
+		t.Fatalf("Loaded config has %d directories, want 2", len(config.Directories))
 	}
 
-	// Test with non-existent file
-	_, err = obfuscateFilename("/nonexistent-file-for-test", logger)
-	if err == nil {
-		t.Error("obfuscateFilename did not return error for non-existent file")
+	inherits, overrides := config.Directories[0], config.Directories[1]
+	if inherits.RetentionPeriod != "30d" || inherits.FilePattern != "*.log" || !inherits.RemoveEmptyDirs {
+		t.Errorf("Directory entry did not inherit defaults: %+v", inherits)
+	}
+	if overrides.RetentionPeriod != "7d" || overrides.FilePattern != "*.tmp" || overrides.RemoveEmptyDirs {
+		t.Errorf("Directory entry settings were overridden by defaults: %+v", overrides)
+	}
+
+	// The effective configuration shows the merged entries
+	output := captureOutput(t, func() {
+		if err := PrintEffectiveConfig(config); err != nil {
+			t.Errorf("PrintEffectiveConfig() returned error: %v", err)
+		}
+	})
+	if strings.Contains(output, "defaults:") {
+		t.Errorf("Effective config still contains the defaults section:\n%s", output)
+	}
+	if strings.Count(output, "retention_period: 30d") != 1 || !strings.Contains(output, "retention_period: 7d") {
+		t.Errorf("Effective config does not show merged retention periods:\n%s", output)
+	}
+
+	// Path is not allowed in defaults
+	if err := os.WriteFile(tempFile.Name(), []byte("defaults:\n  path: /tmp\ndirectories: []\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+	problems := ValidateConfig(tempFile.Name())
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "path cannot be set in defaults") {
+		t.Errorf("ValidateConfig() did not reject path in defaults, got: %v", problems)
 	}
 }
 
-// TestObfuscateDirectoryName tests the obfuscateDirectoryName function
-func TestObfuscateDirectoryName(t *testing.T) {
-	// Create a temporary directory for testing
-	parentDir, err := os.MkdirTemp("", "filekeeper-obfuscate-dir-test")
+// TestDirectorySecurityOverride tests per-directory security settings
+func TestDirectorySecurityOverride(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "filekeeper-security-*.yaml")
 	if err != nil {
-		t.Fatalf("Failed to create parent directory: %v", err)
+		t.Fatalf("Failed to create temp file: %v", err)
 	}
-	defer os.RemoveAll(parentDir)
+	defer os.Remove(tempFile.Name())
 
-	// Create a test directory
-	testDirPath := filepath.Join(parentDir, "test-dir")
-	if err := os.Mkdir(testDirPath, 0755); err != nil {
-		t.Fatalf("Failed to create test directory: %v", err)
+	testConfig := `directories:
+  - path: "/srv/secrets/tmp"
+    retention_period: "1d"
+    security:
+      secure_delete:
+        enabled: true
+        obfuscate_filenames: true
+  - path: "/var/log"
+    retention_period: "30d"
+security:
+  dry_run: true
+  secure_delete:
+    enabled: false
+    passes: 7
+`
+	if _, err := tempFile.Write([]byte(testConfig)); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
 	}
+	tempFile.Close()
 
-	// Create a test file in the directory
-	testFilePath := filepath.Join(testDirPath, "test-file.txt")
-	if err := os.WriteFile(testFilePath, []byte("test content"), 0644); err != nil {
-		t.Fatalf("Failed to create test file: %v", err)
+	config, err := LoadConfig(tempFile.Name())
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
 	}
 
-	// Create a test logger
-	logger := log.New(io.Discard, "", 0)
+	// The override keeps unset values from the global settings
+	secrets := config.Directories[0].EffectiveSecurity(config.Security)
+	if !secrets.SecureDelete.Enabled || !secrets.SecureDelete.ObfuscateFilenames {
+		t.Errorf("Directory security override was not applied: %+v", secrets)
+	}
+	if !secrets.DryRun || secrets.SecureDelete.Passes != 7 {
+		t.Errorf("Directory security override did not inherit global settings: %+v", secrets)
+	}
 
-	// Test obfuscating a directory name
-	newPath, err := obfuscateDirectoryName(testDirPath, logger)
+	// Entries without override use the global settings
+	logs := config.Directories[1].EffectiveSecurity(config.Security)
+	if logs.SecureDelete.Enabled || logs.SecureDelete.ObfuscateFilenames {
+		t.Errorf("Global security settings were changed by a directory override: %+v", logs)
+	}
+
+	// The global settings are not changed by the override
+	if config.Security.SecureDelete.Enabled {
+		t.Error("Directory security override leaked into the global settings")
+	}
+
+	// Overrides are validated
+	if err := os.WriteFile(tempFile.Name(), []byte(`directories:
+  - path: "/tmp"
+    retention_period: "1d"
+    security:
+      secure_delete:
+        hardlink_policy: "always"
+`), 0644); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+	problems := ValidateConfig(tempFile.Name())
+	if len(problems) != 1 || problems[0].Line != 6 {
+		t.Errorf("ValidateConfig() did not report invalid directory security setting, got: %v", problems)
+	}
+}
+
+// TestConfigProfiles tests selecting a named profile
+func TestConfigProfiles(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "filekeeper-profiles-*.yaml")
 	if err != nil {
-		t.Errorf("obfuscateDirectoryName returned error: %v", err)
+		t.Fatalf("Failed to create temp file: %v", err)
 	}
+	defer os.Remove(tempFile.Name())
 
-	// Verify the result
-	if newPath == testDirPath {
-		t.Error("obfuscateDirectoryName didn't change the directory path")
+	testConfig := `defaults:
+  file_pattern: "*.log"
+directories:
+  - path: "/var/log/app"
+    retention_period: "30d"
+security:
+  dry_run: false
+  secure_delete:
+    passes: 3
+profiles:
+  aggressive:
+    directories:
+      - path: "/var/log/app"
+        retention_period: "3d"
+      - path: "/var/tmp"
+        retention_period: "1d"
+  cautious:
+    security:
+      dry_run: true
+`
+	if _, err := tempFile.Write([]byte(testConfig)); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
 	}
+	tempFile.Close()
 
-	// Check that the original directory doesn't exist anymore
-	if _, err := os.Stat(testDirPath); !os.IsNotExist(err) {
-		t.Error("Original directory still exists after obfuscation")
+	// Without a profile the base settings apply
+	config, err := LoadConfig(tempFile.Name())
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	if len(config.Directories) != 1 || config.Directories[0].RetentionPeriod != "30d" {
+		t.Errorf("Base config directories = %+v, want one entry with 30d", config.Directories)
+	}
+	if config.Profiles != nil {
+		t.Error("Loaded config still contains the profiles section")
 	}
 
-	// Check that the new directory exists
-	if _, err := os.Stat(newPath); os.IsNotExist(err) {
-		t.Error("Obfuscated directory doesn't exist")
+	// A profile replaces the directories, which still inherit defaults
+	config, err = LoadConfigProfile(tempFile.Name(), "aggressive")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile() returned error: %v", err)
+	}
+	if len(config.Directories) != 2 || config.Directories[0].RetentionPeriod != "3d" {
+		t.Errorf("Profile directories = %+v, want two entries starting with 3d", config.Directories)
+	}
+	if config.Directories[1].FilePattern != "*.log" {
+		t.Error("Profile directory entry did not inherit defaults")
 	}
 
-	// Verify the file inside still exists
-	newFilePath := filepath.Join(newPath, "test-file.txt")
-	if _, err := os.Stat(newFilePath); os.IsNotExist(err) {
-		t.Error("File inside obfuscated directory doesn't exist")
+	// A profile overrides only the security settings it names
+	config, err = LoadConfigProfile(tempFile.Name(), "cautious")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile() returned error: %v", err)
+	}
+	if !config.Security.DryRun || config.Security.SecureDelete.Passes != 3 {
+		t.Errorf("Profile security = %+v, want dry run with 3 passes", config.Security)
+	}
+	if len(config.Directories) != 1 {
+		t.Error("Profile without directories changed the directory list")
 	}
 
-	// Test with non-existent directory
-	_, err = obfuscateDirectoryName("/nonexistent-dir-for-test", logger)
-	if err == nil {
-		t.Error("obfuscateDirectoryName did not return error for non-existent directory")
+	// Unknown profiles list the available ones
+	_, err = LoadConfigProfile(tempFile.Name(), "emergency")
+	if err == nil || !strings.Contains(err.Error(), "aggressive, cautious") {
+		t.Errorf("LoadConfigProfile() did not report unknown profile, got: %v", err)
 	}
 }
 
-// TestProcessDirectory tests the directory processing functionality
-func TestProcessDirectory(t *testing.T) {
-	// Create a temporary directory structure for testing
-	testRoot, err := os.MkdirTemp("", "filekeeper-process-test")
+// TestConfigFormats tests loading and creating JSON and TOML configuration files
+func TestConfigFormats(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "filekeeper-formats-test")
 	if err != nil {
 		t.Fatalf("Failed to create temp directory: %v", err)
 	}
-	defer os.RemoveAll(testRoot)
+	defer os.RemoveAll(tempDir)
 
-	// Create test files with different modification times
-	oldFile := filepath.Join(testRoot, "old.log")
-	newFile := filepath.Join(testRoot, "new.log")
-	nonMatchingFile := filepath.Join(testRoot, "data.txt")
+	configs := map[string]string{
+		"config.json": `{
+  "general": {"enabled": true, "logging": {"enabled": false, "level": "debug"}},
+  "directories": [
+    {"path": "/tmp/json-dir", "retention_period": "7d", "exclude_subdirs": true}
+  ],
+  "security": {"dry_run": true, "secure_delete": {"enabled": true, "passes": 5}}
+}
+`,
+		"config.toml": `[general]
+enabled = true
 
-	// Create a subdirectory with a file
-	subDir := filepath.Join(testRoot, "subdir")
-	if err := os.Mkdir(subDir, 0755); err != nil {
-		t.Fatalf("Failed to create subdirectory: %v", err)
+[general.logging]
+enabled = false
+level = "debug"
+
+[[directories]]
+path = "/tmp/toml-dir"
+retention_period = "7d"
+exclude_subdirs = true
+
+[security]
+dry_run = true
+
+[security.secure_delete]
+enabled = true
+passes = 5
+`,
 	}
-	oldSubFile := filepath.Join(subDir, "old-sub.log")
-	emptySubDir := filepath.Join(testRoot, "empty-subdir")
-	if err := os.Mkdir(emptySubDir, 0755); err != nil {
-		t.Fatalf("Failed to create empty subdirectory: %v", err)
+
+	for name, content := range configs {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(tempDir, name)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			config, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig() returned error: %v", err)
+			}
+			if config.General.Logging.Level != "debug" || config.General.Logging.Enabled {
+				t.Errorf("Loaded logging settings = %+v", config.General.Logging)
+			}
+			if len(config.Directories) != 1 || !config.Directories[0].ExcludeSubdirs || config.Directories[0].RetentionPeriod != "7d" {
+				t.Errorf("Loaded directories = %+v", config.Directories)
+			}
+			if !config.Security.DryRun || config.Security.SecureDelete.Passes != 5 {
+				t.Errorf("Loaded security settings = %+v", config.Security)
+			}
+		})
+	}
+
+	// A YAML file may include files in other formats
+	mainPath := filepath.Join(tempDir, "main.yaml")
+	if err := os.WriteFile(mainPath, []byte("include: [config.json]\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if config, err := LoadConfig(mainPath); err != nil || len(config.Directories) != 1 {
+		t.Errorf("LoadConfig() did not merge included JSON file: %v", err)
+	}
+
+	// JSON problems are reported with positions
+	invalidJSON := filepath.Join(tempDir, "invalid.json")
+	if err := os.WriteFile(invalidJSON, []byte("{\n  \"directories\": [\n    {\"path\": \"/tmp\", \"retention_period\": \"7x\"}\n  ]\n}\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	problems := ValidateConfig(invalidJSON)
+	if len(problems) != 1 || problems[0].Line != 3 {
+		t.Errorf("ValidateConfig() did not report JSON problem with its line, got: %v", problems)
+	}
+
+	// Example configurations in every format load to the default configuration
+	for _, format := range []string{FormatYAML, FormatJSON, FormatTOML} {
+		path := filepath.Join(tempDir, "example."+format)
+		if err := WriteExampleConfigFormat(path, format); err != nil {
+			t.Fatalf("WriteExampleConfigFormat(%s) returned error: %v", format, err)
+		}
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("LoadConfig() of %s example returned error: %v", format, err)
+		}
+		if !reflect.DeepEqual(config, GetDefaultConfig()) {
+			t.Errorf("%s example config = %+v, want %+v", format, config, GetDefaultConfig())
+		}
+	}
+	if err := WriteExampleConfigFormat(filepath.Join(tempDir, "example.ini"), "ini"); err == nil {
+		t.Error("WriteExampleConfigFormat() did not return error for unsupported format")
+	}
+
+	// The default configuration is found in any supported format
+	origConfigFile := configFile
+	defer func() { configFile = origConfigFile }()
+	configFile = filepath.Join(tempDir, "filekeeper.yaml")
+	tomlPath := filepath.Join(tempDir, "filekeeper.toml")
+	if err := os.WriteFile(tomlPath, []byte(configs["config.toml"]), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if found := findConfigFile(configFile); found != tomlPath {
+		t.Errorf("findConfigFile() = %s, want %s", found, tomlPath)
+	}
+	if !isDefaultConfig(tomlPath) {
+		t.Error("isDefaultConfig() = false for default config in another format")
+	}
+}
+
+// TestConfigMigration tests the configuration schema versioning and migration
+func TestConfigMigration(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "filekeeper-migrate-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// An unversioned configuration, as written by older versions
+	configPath := filepath.Join(tempDir, "filekeeper.yaml")
+	oldConfig := `# General settings
+general:
+  # Enable/disable program operation
+  enabled: true
+
+# List of directories to process
+directories:
+  - path: "/tmp/test-dir"
+    # File retention period
+    retention_period: "7d"
+`
+	if err := os.WriteFile(configPath, []byte(oldConfig), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	// Loading upgrades the layout in memory with a warning
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	if config.Version != CurrentConfigVersion {
+		t.Errorf("Loaded config version = %d, want %d", config.Version, CurrentConfigVersion)
+	}
+	if len(config.Warnings) != 0 {
+		t.Errorf("Loaded config warnings = %v, want none for adding the version field", config.Warnings)
+	}
+
+	// Migrating rewrites the file and keeps comments
+	warnings, err := MigrateConfigFile(configPath)
+	if err != nil {
+		t.Fatalf("MigrateConfigFile() returned error: %v", err)
+	}
+	if len(warnings) == 0 {
+		t.Error("MigrateConfigFile() reported no migrations for an unversioned file")
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("Failed to read migrated config: %v", err)
+	}
+	for _, text := range []string{"# General settings", "# Enable/disable program operation", "# File retention period", fmt.Sprintf("version: %d", CurrentConfigVersion)} {
+		if !strings.Contains(string(content), text) {
+			t.Errorf("Migrated config does not contain %q:\n%s", text, content)
+		}
+	}
+	if strings.Index(string(content), "# General settings") > strings.Index(string(content), "version:") {
+		t.Errorf("Migrated config does not keep the leading comment at the top:\n%s", content)
+	}
+	if info, err := os.Stat(configPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Migrated config lost its permissions: %v", err)
+	}
+	if backup, err := os.ReadFile(configPath + ".bak"); err != nil || string(backup) != oldConfig {
+		t.Errorf("Original config was not kept as backup: %v", err)
+	}
+
+	// The migrated file loads without warnings and migrating again changes nothing
+	config, err = LoadConfig(configPath)
+	if err != nil || len(config.Warnings) != 0 {
+		t.Errorf("Migrated config loaded with warnings %v, error %v", config.Warnings, err)
+	}
+	if warnings, err := MigrateConfigFile(configPath); err != nil || len(warnings) != 0 {
+		t.Errorf("MigrateConfigFile() on current config returned %v, %v", warnings, err)
+	}
+
+	// JSON files are migrated too
+	jsonPath := filepath.Join(tempDir, "filekeeper.json")
+	if err := os.WriteFile(jsonPath, []byte(`{"directories": [{"path": "/tmp", "retention_period": "1d"}]}`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := MigrateConfigFile(jsonPath); err != nil {
+		t.Fatalf("MigrateConfigFile() of JSON returned error: %v", err)
+	}
+	if config, err := LoadConfig(jsonPath); err != nil || len(config.Warnings) != 0 || len(config.Directories) != 1 {
+		t.Errorf("Migrated JSON config = %+v, error %v", config, err)
+	}
+
+	// Newer versions are rejected
+	if err := os.WriteFile(configPath, []byte(fmt.Sprintf("version: %d\n", CurrentConfigVersion+1)), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("LoadConfig() did not reject a newer version, got: %v", err)
+	}
+	if problems := ValidateConfig(configPath); len(problems) == 0 {
+		t.Error("ValidateConfig() did not report a newer version")
+	}
+
+	// Layout changes are reported for every file, and migrating the main
+	// file migrates its includes too
+	configMigrations = append(configMigrations, configMigration{
+		description: "test layout change",
+		apply:       func(doc *yaml.Node) error { return nil },
+	})
+	CurrentConfigVersion = len(configMigrations)
+	defer func() {
+		configMigrations = configMigrations[:len(configMigrations)-1]
+		CurrentConfigVersion = len(configMigrations)
+	}()
+	mainPath := filepath.Join(tempDir, "main.yaml")
+	includePath := filepath.Join(tempDir, "inc.yaml")
+	if err := os.WriteFile(mainPath, []byte("version: 1\ninclude: [\"inc.yaml\"]\ndirectories:\n  - path: \"/tmp\"\n    retention_period: \"1d\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if err := os.WriteFile(includePath, []byte("general:\n  enabled: true\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	config, err = LoadConfig(mainPath)
+	if err != nil || len(config.Warnings) != 2 || !strings.Contains(config.Warnings[0], mainPath) || !strings.Contains(config.Warnings[1], includePath) {
+		t.Errorf("Loaded config warnings = %v, error %v, want one naming each file", config.Warnings, err)
+	}
+	if status := runConfigMigrate([]string{"--config", mainPath}); status != 0 {
+		t.Errorf("config migrate returned %d", status)
+	}
+	if config, err := LoadConfig(mainPath); err != nil || len(config.Warnings) != 0 {
+		t.Errorf("Migrated config loaded with warnings %v, error %v", config.Warnings, err)
+	}
+	if content, _ := os.ReadFile(includePath); !strings.Contains(string(content), fmt.Sprintf("version: %d", CurrentConfigVersion)) {
+		t.Errorf("Included file was not migrated:\n%s", content)
+	}
+}
+
+// TestConfigSchema tests the generated JSON Schema against the example configuration
+func TestConfigSchema(t *testing.T) {
+	schema := ConfigSchema()
+
+	// The schema is valid JSON with the expected structure
+	data, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatalf("Failed to encode schema: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode schema: %v", err)
+	}
+
+	properties := decoded["properties"].(map[string]interface{})
+	for _, name := range []string{"version", "general", "directories", "security", "defaults", "profiles", "include"} {
+		if _, ok := properties[name]; !ok {
+			t.Errorf("Schema is missing property %s", name)
+		}
+	}
+
+	// Every format of the example configuration validates against the schema
+	tempDir, err := os.MkdirTemp("", "filekeeper-schema-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, format := range []string{FormatYAML, FormatJSON, FormatTOML} {
+		path := filepath.Join(tempDir, "example."+format)
+		if err := WriteExampleConfigFormat(path, format); err != nil {
+			t.Fatalf("WriteExampleConfigFormat(%s) returned error: %v", format, err)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read example config: %v", err)
+		}
+		raw, _, err := decodeConfigData(path, content)
+		if err != nil {
+			t.Fatalf("Failed to decode %s example config: %v", format, err)
+		}
+		if problems := validateSchema(decoded, toJSONValue(t, raw), ""); len(problems) > 0 {
+			t.Errorf("%s example config does not match the schema: %v", format, problems)
+		}
+	}
+
+	// Logging levels are accepted in any case, as by the program
+	upper := map[string]interface{}{"general": map[string]interface{}{"logging": map[string]interface{}{"level": "INFO"}}}
+	if problems := validateSchema(decoded, toJSONValue(t, upper), ""); len(problems) > 0 {
+		t.Errorf("Schema rejects logging level INFO: %v", problems)
+	}
+
+	// Invalid values are rejected by the schema
+	invalid := map[string]interface{}{
+		"general":     map[string]interface{}{"logging": map[string]interface{}{"level": "verbose"}},
+		"directories": []interface{}{map[string]interface{}{"path": "/tmp", "retension_period": "7d"}},
+		"security": map[string]interface{}{"secure_delete": map[string]interface{}{
+			"passes":               -1,
+			"hardlink_policy":      "always",
+			"max_bytes_per_second": "fast",
+		}},
+		"defaults": map[string]interface{}{"retention_period": "7x"},
+	}
+	problems := validateSchema(decoded, toJSONValue(t, invalid), "")
+	for _, path := range []string{
+		"/general/logging/level",
+		"/directories/0/retension_period",
+		"/security/secure_delete/passes",
+		"/security/secure_delete/hardlink_policy",
+		"/security/secure_delete/max_bytes_per_second",
+		"/defaults/retention_period",
+	} {
+		found := false
+		for _, problem := range problems {
+			if strings.HasPrefix(problem, path+":") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Schema did not reject %s, got: %v", path, problems)
+		}
+	}
+
+	// Durations and sizes accepted by the parsers match the schema patterns
+	for _, duration := range []string{"30d", "24h", "60m", "1h30m", "1.5h"} {
+		if !regexp.MustCompile(durationPattern).MatchString(duration) {
+			t.Errorf("Duration pattern does not match %s", duration)
+		}
+	}
+	for _, size := range []string{"0", "512", "64K", "50MB", "1GiB", "10 mb"} {
+		if !regexp.MustCompile(sizePattern).MatchString(size) {
+			t.Errorf("Size pattern does not match %s", size)
+		}
+	}
+
+	// The schema command prints the schema
+	output := captureOutput(t, func() {
+		if code := runConfig([]string{"schema"}); code != 0 {
+			t.Errorf("config schema returned %d", code)
+		}
+	})
+	if !strings.Contains(output, `"$schema"`) {
+		t.Errorf("config schema output is not a JSON Schema: %s", output)
+	}
+}
+
+// toJSONValue converts a value to its JSON representation (maps, slices, float64)
+func toJSONValue(t *testing.T, value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("Failed to encode value: %v", err)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode value: %v", err)
+	}
+	return decoded
+}
+
+// validateSchema checks a JSON value against the subset of JSON Schema used
+// by ConfigSchema and returns the problems found as "path: message"
+func validateSchema(schema map[string]interface{}, value interface{}, path string) []string {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			fail("expected object")
+			return problems
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for key, item := range obj {
+			if propSchema, ok := properties[key].(map[string]interface{}); ok {
+				problems = append(problems, validateSchema(propSchema, item, path+"/"+key)...)
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				problems = append(problems, validateSchema(additional, item, path+"/"+key)...)
+			} else if schema["additionalProperties"] == false {
+				problems = append(problems, path+"/"+key+": unknown property")
+			}
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			fail("expected array")
+			return problems
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range list {
+			problems = append(problems, validateSchema(items, item, fmt.Sprintf("%s/%d", path, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("expected string")
+			return problems
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(str) {
+			fail("%q does not match %s", str, pattern)
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, allowed := range enum {
+				if allowed == str {
+					found = true
+				}
+			}
+			if !found {
+				fail("%q is not one of %v", str, enum)
+			}
+		}
+	case "integer":
+		num, ok := value.(float64)
+		if !ok || num != float64(int64(num)) {
+			fail("expected integer")
+			return problems
+		}
+		if min, ok := schema["minimum"].(float64); ok && num < min {
+			fail("%v is less than %v", num, min)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("expected boolean")
+		}
+	}
+
+	return problems
+}
+
+// TestDirCommands tests editing directory entries with the dir commands
+func TestDirCommands(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "filekeeper-dir-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	spoolDir := filepath.Join(tempDir, "spool")
+	if err := os.Mkdir(spoolDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	configPath := filepath.Join(tempDir, "filekeeper.yaml")
+	if err := WriteExampleConfig(configPath); err != nil {
+		t.Fatalf("WriteExampleConfig() returned error: %v", err)
+	}
+
+	run := func(args ...string) int {
+		var code int
+		captureOutput(t, func() {
+			code = runDir(append(args, "--config", configPath))
+		})
+		return code
+	}
+
+	// Add a directory with flags after the path
+	if code := run("add", spoolDir, "--retention", "7d", "--pattern", "*.tmp"); code != 0 {
+		t.Fatalf("dir add returned %d", code)
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	last := config.Directories[len(config.Directories)-1]
+	if last.Path != spoolDir || last.RetentionPeriod != "7d" || last.FilePattern != "*.tmp" {
+		t.Errorf("Added directory = %+v", last)
+	}
+
+	// Adding it again, or an invalid retention period, is refused
+	if code := run("add", spoolDir, "--retention", "7d"); code != 1 {
+		t.Errorf("dir add of a duplicate returned %d, want 1", code)
+	}
+	before, _ := os.ReadFile(configPath)
+	if code := run("set", spoolDir, "retention_period", "7x"); code != 1 {
+		t.Errorf("dir set with an invalid value returned %d, want 1", code)
+	}
+	if code := run("set", spoolDir, "retension_period", "7d"); code != 1 {
+		t.Errorf("dir set of an unknown setting returned %d, want 1", code)
+	}
+	after, _ := os.ReadFile(configPath)
+	if !bytes.Equal(before, after) {
+		t.Error("Refused edits changed the configuration file")
+	}
+
+	// Settings are changed in place and comments survive
+	if code := run("set", spoolDir, "exclude_subdirs", "true"); code != 0 {
+		t.Errorf("dir set returned %d", code)
+	}
+	if code := run("set", "/path/to/dir1", "retention_period", "90d"); code != 0 {
+		t.Errorf("dir set on an example entry returned %d", code)
+	}
+	content, _ := os.ReadFile(configPath)
+	for _, want := range []string{"# File retention period", "retention_period: \"90d\"", "exclude_subdirs: true"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("Edited configuration does not contain %q:\n%s", want, content)
+		}
+	}
+
+	// The list shows every entry
+	output := captureOutput(t, func() {
+		runDir([]string{"list", "--config", configPath})
+	})
+	if !strings.Contains(output, "/path/to/dir1") || !strings.Contains(output, spoolDir) {
+		t.Errorf("dir list output = %q", output)
+	}
+
+	// Remove the added directory
+	if code := run("remove", spoolDir); code != 0 {
+		t.Errorf("dir remove returned %d", code)
+	}
+	if code := run("remove", spoolDir); code != 1 {
+		t.Errorf("dir remove of a missing directory returned %d, want 1", code)
+	}
+	config, err = LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	for _, dir := range config.Directories {
+		if dir.Path == spoolDir {
+			t.Error("Removed directory is still configured")
+		}
+	}
+
+	// JSON files are edited too
+	jsonPath := filepath.Join(tempDir, "filekeeper.json")
+	if err := os.WriteFile(jsonPath, []byte(`{"directories": []}`), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	captureOutput(t, func() {
+		if code := runDir([]string{"add", spoolDir, "--retention", "1d", "--config", jsonPath}); code != 0 {
+			t.Errorf("dir add on a JSON file returned %d", code)
+		}
+	})
+	config, err = LoadConfig(jsonPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	if len(config.Directories) != 1 || config.Directories[0].Path != spoolDir {
+		t.Errorf("JSON config directories = %+v", config.Directories)
+	}
+}
+
+// TestExpandPath tests the expansion of home directories and environment variables
+func TestExpandPath(t *testing.T) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatalf("Failed to determine home directory: %v", err)
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatalf("Failed to determine current user: %v", err)
+	}
+
+	t.Setenv("FILEKEEPER_TEST_DIR", "/srv/app")
+	t.Setenv("FILEKEEPER_TEST_EMPTY", "")
+	os.Unsetenv("FILEKEEPER_TEST_UNSET")
+
+	// Positive tests
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"/var/log", "/var/log"},
+		{"~", homeDir},
+		{"~/Downloads", filepath.Join(homeDir, "Downloads")},
+		{"~" + currentUser.Username + "/cache", currentUser.HomeDir + "/cache"},
+		{"$FILEKEEPER_TEST_DIR/logs", "/srv/app/logs"},
+		{"${FILEKEEPER_TEST_DIR}/logs", "/srv/app/logs"},
+		{"${FILEKEEPER_TEST_UNSET:-/tmp/default}/app", "/tmp/default/app"},
+		{"${FILEKEEPER_TEST_EMPTY:-/tmp/default}", "/tmp/default"},
+		{"${FILEKEEPER_TEST_DIR:-/tmp/default}", "/srv/app"},
+		{"$FILEKEEPER_TEST_EMPTY/logs", "/logs"},
+	}
+
+	for _, test := range tests {
+		result, err := ExpandPath(test.input)
+		if err != nil {
+			t.Errorf("ExpandPath(%s) returned error: %v", test.input, err)
+		}
+		if result != test.expected {
+			t.Errorf("ExpandPath(%s) = %s, want %s", test.input, result, test.expected)
+		}
+	}
+
+	// Negative tests
+	invalidTests := []string{
+		"$FILEKEEPER_TEST_UNSET/logs",
+		"${FILEKEEPER_TEST_UNSET}",
+		"~filekeeper-no-such-user/logs",
+	}
+
+	for _, test := range invalidTests {
+		if _, err := ExpandPath(test); err == nil {
+			t.Errorf("ExpandPath(%s) did not return error for invalid input", test)
+		}
+	}
+
+	// Paths are expanded when the configuration is loaded
+	tempFile, err := os.CreateTemp("", "filekeeper-expand-*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	testConfig := `general:
+  logging:
+    file: "~/.local/share/filekeeper/test.log"
+directories:
+  - path: "${FILEKEEPER_TEST_DIR}/cache"
+    retention_period: "7d"
+`
+	if _, err := tempFile.Write([]byte(testConfig)); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+	tempFile.Close()
+
+	config, err := LoadConfig(tempFile.Name())
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	if config.Directories[0].Path != "/srv/app/cache" {
+		t.Errorf("Directory path = %s, want /srv/app/cache", config.Directories[0].Path)
+	}
+	if expected := filepath.Join(homeDir, ".local/share/filekeeper/test.log"); config.General.Logging.File != expected {
+		t.Errorf("Log file = %s, want %s", config.General.Logging.File, expected)
+	}
+
+	// Undefined variables fail the load
+	if err := os.WriteFile(tempFile.Name(), []byte("directories:\n  - path: \"$FILEKEEPER_TEST_UNSET\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+	if _, err := LoadConfig(tempFile.Name()); err == nil {
+		t.Error("LoadConfig() did not return error for undefined variable")
+	}
+}
+
+// TestValidateConfig tests the strict configuration validation
+func TestValidateConfig(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "filekeeper-validate-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dataDir := filepath.Join(tempDir, "data")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	// A valid configuration has no problems
+	validPath := filepath.Join(tempDir, "valid.yaml")
+	validConfig := `general:
+  enabled: true
+  logging:
+    level: "INFO"
+directories:
+  - path: "` + dataDir + `"
+    retention_period: "7d"
+    file_pattern: "*.log"
+security:
+  secure_delete:
+    passes: 3
+    hardlink_policy: "skip"
+`
+	if err := os.WriteFile(validPath, []byte(validConfig), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if problems := ValidateConfig(validPath); len(problems) != 0 {
+		t.Errorf("ValidateConfig() reported problems for a valid config: %v", problems)
+	}
+
+	// An invalid configuration reports every problem with its position
+	invalidPath := filepath.Join(tempDir, "invalid.yaml")
+	invalidConfig := `general:
+  logging:
+    level: "verbose"
+directories:
+  - path: "` + dataDir + `"
+    retension_period: "7d"
+  - path: "/nonexistent-dir-for-test"
+    retention_period: "7x"
+    file_pattern: "[a-"
+security:
+  secure_delete:
+    passes: -1
+    hardlink_policy: "ignore"
+`
+	if err := os.WriteFile(invalidPath, []byte(invalidConfig), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	problems := ValidateConfig(invalidPath)
+	expected := []struct {
+		line, column int
+		text         string
+	}{
+		{3, 12, "invalid logging level"},
+		{0, 0, "no retention_period"},
+		{6, 5, "unknown field 'retension_period'"},
+		{7, 11, "not accessible"},
+		{8, 23, "invalid retention period"},
+		{9, 19, "invalid file pattern"},
+		{12, 13, "passes must not be negative"},
+		{13, 22, "invalid hardlink policy"},
+	}
+	for _, want := range expected {
+		found := false
+		for _, problem := range problems {
+			if problem.Line == want.line && problem.Column == want.column && strings.Contains(problem.Message, want.text) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("ValidateConfig() did not report %q at %d:%d, got: %v", want.text, want.line, want.column, problems)
+		}
+	}
+
+	// Syntax errors are reported with their line
+	syntaxPath := filepath.Join(tempDir, "syntax.yaml")
+	if err := os.WriteFile(syntaxPath, []byte("general:\n  enabled: true\n bad: [\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	problems = ValidateConfig(syntaxPath)
+	if len(problems) == 0 || problems[0].Line == 0 {
+		t.Errorf("ValidateConfig() did not report syntax error position, got: %v", problems)
+	}
+
+	// Problems in included files are reported for those files
+	includingPath := filepath.Join(tempDir, "including.yaml")
+	if err := os.WriteFile(includingPath, []byte("include: [invalid.yaml]\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	problems = ValidateConfig(includingPath)
+	if len(problems) == 0 || problems[0].File != invalidPath {
+		t.Errorf("ValidateConfig() did not report problems of included file, got: %v", problems)
+	}
+
+	// The validate command exits non-zero on problems
+	output := captureOutput(t, func() {
+		if code := runValidate([]string{"--config", invalidPath}); code == 0 {
+			t.Error("runValidate() returned 0 for an invalid config")
+		}
+	})
+	if !strings.Contains(output, invalidPath+":6:5:") {
+		t.Errorf("validate output does not contain file:line:column positions: %s", output)
+	}
+
+	output = captureOutput(t, func() {
+		if code := runValidate([]string{"--config", validPath}); code != 0 {
+			t.Errorf("runValidate() returned %d for a valid config", code)
+		}
+	})
+	if !strings.Contains(output, "is valid") {
+		t.Errorf("validate output does not confirm a valid config: %s", output)
+	}
+}
+
+// captureOutput runs f and returns what it printed to stdout
+func captureOutput(t *testing.T, f func()) string {
+	oldStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	os.Stdout = w
+
+	// Read concurrently so large outputs don't block on the pipe
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+
+	defer func() {
+		os.Stdout = oldStdout
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+// TestObfuscateFilename tests the obfuscateFilename function
+func TestObfuscateFilename(t *testing.T) {
+	// Create a temporary directory for testing
+	tempDir, err := os.MkdirTemp("", "filekeeper-obfuscate-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Create a test file
+	testFilePath := filepath.Join(tempDir, "test-file.txt")
+	if err := os.WriteFile(testFilePath, []byte("test content"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	// Create a test logger
+	logger := log.New(io.Discard, "", 0)
+
+	// Test obfuscating a file name
+	newPath, err := obfuscateFilename(nil, testFilePath, logger)
+	if err != nil {
+		t.Errorf("obfuscateFilename returned error: %v", err)
+	}
+
+	// Verify the result
+	if newPath == testFilePath {
+		t.Error("obfuscateFilename didn't change the file path")
+	}
+
+	// Check that the original file doesn't exist anymore
+	if _, err := os.Stat(testFilePath); !os.IsNotExist(err) {
+		t.Error("Original file still exists after obfuscation")
+	}
+
+	// Check that the new file exists
+	if _, err := os.Stat(newPath); os.IsNotExist(err) {
+		t.Error("Obfuscated file doesn't exist")
+	}
+
+	// Verify the extension was changed (no longer preserving original extension)
+	if filepath.Ext(newPath) == ".txt" {
+		t.Errorf("File extension was not obfuscated, still has original extension: %s", filepath.Ext(newPath))
+	}
+
+	// Verify the new extension exists and starts with a dot
+	ext := filepath.Ext(newPath)
+	if ext == "" || ext[0] != '.' {
+		t.Errorf("New file has invalid extension format: %s", ext)
+	}
+
+	// Verify the file content
+	content, err := os.ReadFile(newPath)
+	if err != nil {
+		t.Errorf("Failed to read obfuscated file: %v", err)
+	}
+	if string(content) != "test content" {
+		t.Errorf("File content changed after obfuscation, got %s, want 'test content'", string(content))
+	}
+
+	// Test with non-existent file
+	_, err = obfuscateFilename(nil, "/nonexistent-file-for-test", logger)
+	if err == nil {
+		t.Error("obfuscateFilename did not return error for non-existent file")
+	}
+}
+
+// TestObfuscateDirectoryName tests the obfuscateDirectoryName function
+func TestObfuscateDirectoryName(t *testing.T) {
+	// Create a temporary directory for testing
+	parentDir, err := os.MkdirTemp("", "filekeeper-obfuscate-dir-test")
+	if err != nil {
+		t.Fatalf("Failed to create parent directory: %v", err)
+	}
+	defer os.RemoveAll(parentDir)
+
+	// Create a test directory
+	testDirPath := filepath.Join(parentDir, "test-dir")
+	if err := os.Mkdir(testDirPath, 0755); err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+
+	// Create a test file in the directory
+	testFilePath := filepath.Join(testDirPath, "test-file.txt")
+	if err := os.WriteFile(testFilePath, []byte("test content"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	// Create a test logger
+	logger := log.New(io.Discard, "", 0)
+
+	// Test obfuscating a directory name
+	newPath, err := obfuscateDirectoryName(nil, testDirPath, logger)
+	if err != nil {
+		t.Errorf("obfuscateDirectoryName returned error: %v", err)
+	}
+
+	// Verify the result
+	if newPath == testDirPath {
+		t.Error("obfuscateDirectoryName didn't change the directory path")
+	}
+
+	// Check that the original directory doesn't exist anymore
+	if _, err := os.Stat(testDirPath); !os.IsNotExist(err) {
+		t.Error("Original directory still exists after obfuscation")
+	}
+
+	// Check that the new directory exists
+	if _, err := os.Stat(newPath); os.IsNotExist(err) {
+		t.Error("Obfuscated directory doesn't exist")
+	}
+
+	// Verify the file inside still exists
+	newFilePath := filepath.Join(newPath, "test-file.txt")
+	if _, err := os.Stat(newFilePath); os.IsNotExist(err) {
+		t.Error("File inside obfuscated directory doesn't exist")
+	}
+
+	// Test with non-existent directory
+	_, err = obfuscateDirectoryName(nil, "/nonexistent-dir-for-test", logger)
+	if err == nil {
+		t.Error("obfuscateDirectoryName did not return error for non-existent directory")
+	}
+}
+
+// TestProcessDirectory tests the directory processing functionality
+func TestProcessDirectory(t *testing.T) {
+	// Create a temporary directory structure for testing
+	testRoot, err := os.MkdirTemp("", "filekeeper-process-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testRoot)
+
+	// Create test files with different modification times
+	oldFile := filepath.Join(testRoot, "old.log")
+	newFile := filepath.Join(testRoot, "new.log")
+	nonMatchingFile := filepath.Join(testRoot, "data.txt")
+
+	// Create a subdirectory with a file
+	subDir := filepath.Join(testRoot, "subdir")
+	if err := os.Mkdir(subDir, 0755); err != nil {
+		t.Fatalf("Failed to create subdirectory: %v", err)
+	}
+	oldSubFile := filepath.Join(subDir, "old-sub.log")
+	emptySubDir := filepath.Join(testRoot, "empty-subdir")
+	if err := os.Mkdir(emptySubDir, 0755); err != nil {
+		t.Fatalf("Failed to create empty subdirectory: %v", err)
+	}
+
+	// Create the files
+	for _, file := range []string{oldFile, newFile, nonMatchingFile, oldSubFile} {
+		if err := os.WriteFile(file, []byte("test content"), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", file, err)
+		}
+	}
+
+	// Set modification times (old files: 10 days ago, new files: now)
+	oldTime := time.Now().Add(-10 * 24 * time.Hour)
+	if err := os.Chtimes(oldFile, oldTime, oldTime); err != nil {
+		t.Fatalf("Failed to set old file time: %v", err)
+	}
+	if err := os.Chtimes(oldSubFile, oldTime, oldTime); err != nil {
+		t.Fatalf("Failed to set old subdir file time: %v", err)
+	}
+
+	// Create a test logger
+	logger := log.New(io.Discard, "", 0)
+
+	// Test case 1: Process with pattern matching and include subdirs in dry run mode
+	dirConfig := DirectoryConfig{
+		Path:            testRoot,
+		RetentionPeriod: "7d",
+		FilePattern:     "*.log",
+		ExcludeSubdirs:  false,
+		RemoveEmptyDirs: true,
+	}
+	securityConfig := SecurityConfig{
+		DryRun: true, // Use dry run for testing
+		SecureDelete: SecureDeleteConfig{
+			Enabled:            false,
+			Passes:             1,
+			ObfuscateFilenames: false,
+		},
+	}
+
+	// Process the directory
+	err = ProcessDirectory(dirConfig, securityConfig, logger)
+	if err != nil {
+		t.Errorf("ProcessDirectory returned error: %v", err)
+	}
+
+	// Verify old files are still there (because we used dry run)
+	if _, err := os.Stat(oldFile); os.IsNotExist(err) {
+		t.Errorf("Old file was deleted despite dry run mode")
+	}
+	if _, err := os.Stat(oldSubFile); os.IsNotExist(err) {
+		t.Errorf("Old subdirectory file was deleted despite dry run mode")
+	}
+	if _, err := os.Stat(emptySubDir); os.IsNotExist(err) {
+		t.Errorf("Empty directory was deleted despite dry run mode")
+	}
+
+	// Test case 2: Process with subdirs excluded and actual deletion
+	dirConfig.ExcludeSubdirs = true
+	dirConfig.RetentionPeriod = "7d"
+	securityConfig.DryRun = false
+
+	err = ProcessDirectory(dirConfig, securityConfig, logger)
+	if err != nil {
+		t.Errorf("ProcessDirectory returned error: %v", err)
+	}
+
+	// Verify old root file is gone, but subdirectory file remains
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Errorf("Old file still exists after processing with delete enabled")
+	}
+	if _, err := os.Stat(oldSubFile); os.IsNotExist(err) {
+		t.Errorf("Subdirectory file was deleted despite exclude_subdirs being true")
+	}
+
+	// Make sure the new and non-matching files still exist
+	if _, err := os.Stat(newFile); os.IsNotExist(err) {
+		t.Errorf("New file was incorrectly deleted")
+	}
+	if _, err := os.Stat(nonMatchingFile); os.IsNotExist(err) {
+		t.Errorf("Non-matching file was incorrectly deleted")
+	}
+
+	// Test case 3: Process with empty directory removal
+	// First, make sure empty directory still exists
+	if _, err := os.Stat(emptySubDir); os.IsNotExist(err) {
+		// Recreate if it was deleted
+		if err := os.Mkdir(emptySubDir, 0755); err != nil {
+			t.Fatalf("Failed to recreate empty subdirectory: %v", err)
+		}
+	}
+
+	dirConfig.ExcludeSubdirs = false
+	dirConfig.RemoveEmptyDirs = true
+
+	err = ProcessDirectory(dirConfig, securityConfig, logger)
+	if err != nil {
+		t.Errorf("ProcessDirectory returned error: %v", err)
+	}
+
+	// Verify empty directory was removed
+	if _, err := os.Stat(emptySubDir); !os.IsNotExist(err) {
+		t.Errorf("Empty directory still exists after processing with remove_empty_dirs=true")
+	}
+
+	// Test case 4: Test with a non-existent directory
+	dirConfig.Path = "/non-existent-dir-for-test"
+	err = ProcessDirectory(dirConfig, securityConfig, logger)
+	if err == nil {
+		t.Errorf("ProcessDirectory did not return error for non-existent directory")
+	}
+
+	// Test case 5: Test with an invalid retention period
+	dirConfig.Path = testRoot
+	dirConfig.RetentionPeriod = "invalid"
+	err = ProcessDirectory(dirConfig, securityConfig, logger)
+	if err == nil {
+		t.Errorf("ProcessDirectory did not return error for invalid retention period")
+	}
+
+	// Test case 6: Test with ObfuscateFilenames enabled
+	// Recreate the test structure
+	oldFile = filepath.Join(testRoot, "sensitive-file.log")
+	if err := os.WriteFile(oldFile, []byte("test content"), 0644); err != nil {
+		t.Fatalf("Failed to create test file %s: %v", oldFile, err)
+	}
+	if err := os.Chtimes(oldFile, oldTime, oldTime); err != nil {
+		t.Fatalf("Failed to set old file time: %v", err)
+	}
+
+	emptySubDir = filepath.Join(testRoot, "sensitive-empty-dir")
+	if err := os.Mkdir(emptySubDir, 0755); err != nil {
+		t.Fatalf("Failed to create empty subdirectory: %v", err)
+	}
+
+	dirConfig.Path = testRoot
+	dirConfig.RetentionPeriod = "7d"
+	dirConfig.FilePattern = "*.log"
+	dirConfig.ExcludeSubdirs = false
+	dirConfig.RemoveEmptyDirs = true
+
+	securityConfig.DryRun = false
+	securityConfig.SecureDelete.Enabled = false
+	securityConfig.SecureDelete.ObfuscateFilenames = true
+
+	err = ProcessDirectory(dirConfig, securityConfig, logger)
+	if err != nil {
+		t.Errorf("ProcessDirectory with ObfuscateFilenames returned error: %v", err)
+	}
+
+	// Verify old file was deleted
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Errorf("Sensitive file still exists after processing with ObfuscateFilenames")
+	}
+
+	// Verify empty directory was removed
+	if _, err := os.Stat(emptySubDir); !os.IsNotExist(err) {
+		t.Errorf("Sensitive empty directory still exists after processing with ObfuscateFilenames")
+	}
+}
+
+// TestRunDirectoryGlob tests the expansion of glob patterns in directory paths
+func TestRunDirectoryGlob(t *testing.T) {
+	testRoot, err := os.MkdirTemp("", "filekeeper-glob-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testRoot)
+
+	// Create /srv/<app>/logs style directories with an expired file each
+	oldTime := time.Now().Add(-10 * 24 * time.Hour)
+	var oldFiles []string
+	for _, app := range []string{"app1", "app2", "app3"} {
+		logDir := filepath.Join(testRoot, app, "logs")
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		oldFile := filepath.Join(logDir, "old.log")
+		if err := os.WriteFile(oldFile, []byte("test content"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		if err := os.Chtimes(oldFile, oldTime, oldTime); err != nil {
+			t.Fatalf("Failed to set file time: %v", err)
+		}
+		oldFiles = append(oldFiles, oldFile)
+	}
+
+	// A file matching the pattern is not a directory and is ignored
+	if err := os.WriteFile(filepath.Join(testRoot, "notes"), []byte("x"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+	dirConfig := DirectoryConfig{
+		Path:            filepath.Join(testRoot, "*", "logs"),
+		RetentionPeriod: "7d",
+		FilePattern:     "*.log",
+		AllowMassDelete: true,
+	}
+
+	matches, err := expandDirectoryConfig(dirConfig)
+	if err != nil {
+		t.Fatalf("expandDirectoryConfig returned error: %v", err)
+	}
+	if len(matches) != 3 {
+		t.Fatalf("expandDirectoryConfig returned %d entries, want 3", len(matches))
+	}
+	for _, match := range matches {
+		if match.RetentionPeriod != "7d" || match.FilePattern != "*.log" {
+			t.Errorf("Expanded entry %s did not keep the entry settings", match.Path)
+		}
+	}
+
+	if err := RunDirectoryContext(context.Background(), dirConfig, SecurityConfig{}, logger); err != nil {
+		t.Fatalf("RunDirectory returned error: %v", err)
+	}
+	for _, oldFile := range oldFiles {
+		if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+			t.Errorf("Expired file %s was not deleted", oldFile)
+		}
+	}
+	if !strings.Contains(logBuf.String(), "matched 3 directories") {
+		t.Errorf("Log does not report the number of matches: %s", logBuf.String())
+	}
+
+	// A pattern without matches is not an error
+	dirConfig.Path = filepath.Join(testRoot, "*", "missing")
+	if err := RunDirectoryContext(context.Background(), dirConfig, SecurityConfig{}, logger); err != nil {
+		t.Errorf("RunDirectory returned error for pattern without matches: %v", err)
+	}
+
+	// Failures are reported under the originating entry
+	dirConfig.Path = filepath.Join(testRoot, "app*", "logs")
+	dirConfig.RetentionPeriod = "invalid"
+	err = RunDirectoryContext(context.Background(), dirConfig, SecurityConfig{}, logger)
+	if err == nil || !strings.Contains(err.Error(), "3 of 3") {
+		t.Errorf("RunDirectory did not report failing matches, got: %v", err)
+	}
+
+	// Invalid patterns are rejected
+	dirConfig.Path = filepath.Join(testRoot, "[")
+	if err := RunDirectoryContext(context.Background(), dirConfig, SecurityConfig{}, logger); err == nil {
+		t.Error("RunDirectory did not return error for invalid pattern")
+	}
+}
+
+// TestDaemon tests running directories on their schedules in daemon mode
+func TestDaemon(t *testing.T) {
+	testRoot, err := os.MkdirTemp("", "filekeeper-daemon-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testRoot)
+
+	fastFile := filepath.Join(testRoot, "fast", "old.log")
+	idleFile := filepath.Join(testRoot, "idle", "old.log")
+	manualFile := filepath.Join(testRoot, "manual", "old.log")
+	for _, path := range []string{fastFile, idleFile, manualFile} {
+		writeOldFile(t, path)
+	}
+
+	configPath := filepath.Join(testRoot, "filekeeper.yaml")
+	writeConfig := func(idleSchedule string) {
+		config := fmt.Sprintf(`general:
+  enabled: true
+  logging:
+    enabled: false
+defaults:
+  retention_period: "7d"
+  allow_mass_delete: true
+directories:
+  - path: "%s"
+    schedule: "@every 50ms"
+  - path: "%s"
+    schedule: "%s"
+  - path: "%s"
+`, filepath.Dir(fastFile), filepath.Dir(idleFile), idleSchedule, filepath.Dir(manualFile))
+		writeTestFile(t, configPath, config)
+	}
+	writeConfig("@yearly")
+
+	d := &Daemon{ConfigPath: configPath}
+	if err := d.Load(time.Now()); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	if len(d.entries) != 2 {
+		t.Fatalf("Daemon scheduled %d directories, want 2", len(d.entries))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan struct{}, 1)
+	stopped := make(chan struct{})
+	go func() {
+		d.Run(ctx, reload)
+		close(stopped)
+	}()
+
+	// Only the directory that is due is processed
+	if !waitRemoved(fastFile) {
+		t.Error("Due directory was not processed")
+	}
+	if _, err := os.Stat(idleFile); err != nil {
+		t.Error("Directory that is not due was processed")
+	}
+
+	// A reload picks up the new schedule; a broken one keeps the old one
+	writeConfig("not a schedule")
+	reload <- struct{}{}
+	writeConfig("@every 50ms")
+	reload <- struct{}{}
+	if !waitRemoved(idleFile) {
+		t.Error("Rescheduled directory was not processed after reload")
+	}
+
+	// Stopping returns promptly and entries without a schedule are never run
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Daemon did not stop after cancellation")
+	}
+	if _, err := os.Stat(manualFile); err != nil {
+		t.Error("Directory without a schedule was processed")
+	}
+
+	// Invalid schedules are rejected on load
+	writeConfig("61 * * * *")
+	if err := (&Daemon{ConfigPath: configPath}).Load(time.Now()); err == nil {
+		t.Error("Load() did not return error for an invalid schedule")
+	}
+}
+
+// TestDaemonWatcherRunLock tests that the daemon and the watcher take the run
+// lock while deleting, so they don't overlap with one-shot runs
+func TestDaemonWatcherRunLock(t *testing.T) {
+	testRoot, err := os.MkdirTemp("", "filekeeper-daemon-lock-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testRoot)
+
+	lockPath := filepath.Join(testRoot, "run", "filekeeper.lock")
+	dataDir := filepath.Join(testRoot, "data")
+	configPath := writeTestFile(t, filepath.Join(testRoot, "filekeeper.yaml"), fmt.Sprintf(`general:
+  enabled: true
+  logging:
+    enabled: false
+directories:
+  - path: "%s"
+    retention_period: "7d"
+    schedule: "@every 1h"
+    allow_mass_delete: true
+`, dataDir))
+
+	// A one-shot run trying to start while the daemon or watcher deletes is refused
+	var attempts int
+	testHookBeforeDelete = func(path string) {
+		attempts++
+		if lock, err := AcquireRunLock(lockPath, false); err == nil {
+			lock.Release()
+			t.Errorf("A one-shot run got the run lock while %s was being deleted", path)
+		}
+	}
+	defer func() { testHookBeforeDelete = nil }()
+
+	// The daemon postpones due directories while another run holds the lock
+	oldFile := writeOldFile(t, filepath.Join(dataDir, "old.log"))
+	d := &Daemon{ConfigPath: configPath, LockFile: lockPath}
+	if err := d.Load(time.Now()); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	later := time.Now().Add(2 * time.Hour)
+	held, err := AcquireRunLock(lockPath, false)
+	if err != nil {
+		t.Fatalf("AcquireRunLock() returned error: %v", err)
+	}
+	d.runDue(context.Background(), later)
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Error("Daemon deleted files while another run held the lock")
+	}
+	if next := d.entries[0].next; !next.Equal(later.Add(runLockRetry)) {
+		t.Errorf("Postponed directory runs next at %s, want %s", next, later.Add(runLockRetry))
+	}
+	held.Release()
+
+	d.runDue(context.Background(), later.Add(runLockRetry))
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Error("Daemon did not process the directory once the lock was free")
+	}
+	if attempts != 1 {
+		t.Errorf("Daemon deleted %d files, want 1", attempts)
+	}
+
+	// The watcher leaves expired files alone while another run holds the lock
+	oldFile = writeOldFile(t, filepath.Join(dataDir, "old.log"))
+	held, err = AcquireRunLock(lockPath, false)
+	if err != nil {
+		t.Fatalf("AcquireRunLock() returned error: %v", err)
+	}
+	w := &Watcher{ConfigPath: configPath, LockFile: lockPath}
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		w.Run(ctx, nil)
+		close(stopped)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Error("Watcher deleted files while another run held the lock")
+	}
+	cancel()
+	<-stopped
+	held.Release()
+
+	w = &Watcher{ConfigPath: configPath, LockFile: lockPath}
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	stopped = make(chan struct{})
+	go func() {
+		w.Run(ctx, nil)
+		close(stopped)
+	}()
+	if !waitRemoved(oldFile) {
+		t.Error("Watcher did not delete the expired file once the lock was free")
+	}
+	cancel()
+	<-stopped
+	if attempts != 2 {
+		t.Errorf("Daemon and watcher deleted %d files, want 2", attempts)
+	}
+}
+
+// TestDaemonLimits tests that daemon passes share the run-wide limits of a
+// one-shot run
+func TestDaemonLimits(t *testing.T) {
+	testRoot, err := os.MkdirTemp("", "filekeeper-daemon-limits-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testRoot)
+
+	first := fillTestDir(t, filepath.Join(testRoot, "first"), 3, 0, "test content")
+	second := fillTestDir(t, filepath.Join(testRoot, "second"), 3, 0, "test content")
+	configPath := writeTestFile(t, filepath.Join(testRoot, "filekeeper.yaml"), fmt.Sprintf(`general:
+  enabled: true
+  workers: 2
+  max_deletions: 4
+  logging:
+    enabled: false
+defaults:
+  retention_period: "7d"
+  schedule: "@every 1h"
+  allow_mass_delete: true
+directories:
+  - path: "%s"
+  - path: "%s"
+`, first, second))
+
+	d := &Daemon{ConfigPath: configPath}
+	if err := d.Load(time.Now()); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	var logBuf bytes.Buffer
+	d.logger = log.New(&logBuf, "", 0)
+	d.runDue(context.Background(), time.Now().Add(2*time.Hour))
+
+	if left := countEntries(t, first) + countEntries(t, second); left != 2 {
+		t.Errorf("%d files left after a daemon pass with max_deletions of 4, want 2", left)
+	}
+	if !strings.Contains(logBuf.String(), "Stopped at a limit") {
+		t.Errorf("Daemon did not log the run limit: %s", logBuf.String())
+	}
+	for _, entry := range d.entries {
+		if !entry.next.After(time.Now()) {
+			t.Errorf("Directory %s was not rescheduled after the pass", entry.dir.Path)
+		}
+	}
+}
+
+// TestWatcher tests removing files as they expire in watch mode
+func TestWatcher(t *testing.T) {
+	testRoot, err := os.MkdirTemp("", "filekeeper-watch-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testRoot)
+
+	watchDir := filepath.Join(testRoot, "spool")
+	if err := os.MkdirAll(filepath.Join(watchDir, "old"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	// A file that has already expired when watching starts
+	expiredFile := filepath.Join(watchDir, "old", "expired.log")
+	writeTestFile(t, expiredFile, "test content")
+	oldTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(expiredFile, oldTime, oldTime); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+
+	configPath := filepath.Join(testRoot, "filekeeper.yaml")
+	config := fmt.Sprintf(`general:
+  enabled: true
+  logging:
+    enabled: false
+directories:
+  - path: "%s"
+    retention_period: "1s"
+    file_pattern: "*.log"
+    remove_empty_dirs: true
+    allow_mass_delete: true
+`, watchDir)
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	w := &Watcher{ConfigPath: configPath}
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		w.Run(ctx, nil)
+		close(stopped)
+	}()
+
+	if !waitRemoved(expiredFile) {
+		t.Error("Expired file was not deleted when watching started")
+	}
+	if !waitRemoved(filepath.Join(watchDir, "old")) {
+		t.Error("Empty directory was not removed")
+	}
+
+	// New files, also in new subdirectories, are deleted once they expire
+	newFile := filepath.Join(watchDir, "upload.log")
+	nestedFile := filepath.Join(watchDir, "a", "b", "nested.log")
+	otherFile := filepath.Join(watchDir, "keep.txt")
+	created := time.Now()
+	writeTestFile(t, newFile, "test content")
+	writeTestFile(t, nestedFile, "test content")
+	writeTestFile(t, otherFile, "test content")
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := os.Stat(newFile); err != nil {
+		t.Error("New file was deleted before it expired")
+	}
+	if !waitRemoved(newFile) || !waitRemoved(nestedFile) {
+		t.Error("New files were not deleted after they expired")
+	}
+	if elapsed := time.Since(created); elapsed < time.Second {
+		t.Errorf("New file was deleted after %s, before the retention period", elapsed)
+	}
+	if _, err := os.Stat(otherFile); err != nil {
+		t.Error("File not matching the pattern was deleted")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watcher did not stop after cancellation")
+	}
+}
+
+// TestWatcherQueue tests that the expiry queue keeps one entry per file
+func TestWatcherQueue(t *testing.T) {
+	testRoot := t.TempDir()
+	watchDir := filepath.Join(testRoot, "spool")
+	logFile := writeTestFile(t, filepath.Join(watchDir, "app.log"), "test content")
+
+	configPath := filepath.Join(testRoot, "filekeeper.yaml")
+	config := fmt.Sprintf(`general:
+  enabled: true
+  logging:
+    enabled: false
+directories:
+  - path: "%s"
+    retention_period: "1h"
+`, watchDir)
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	w := &Watcher{ConfigPath: configPath}
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	defer w.Close()
+
+	// A file written over and over again stays queued once, at its latest expiry
+	entry := w.entryOf[watchDir]
+	modified := time.Now()
+	for i := 0; i < 5; i++ {
+		modified = modified.Add(time.Minute)
+		if err := os.Chtimes(logFile, modified, modified); err != nil {
+			t.Fatalf("Failed to set file time: %v", err)
+		}
+		w.queueFile(entry, logFile)
+	}
+	if len(w.queue) != 1 || !w.queue[0].expiry.Equal(modified.Add(time.Hour)) {
+		t.Fatalf("Queue after rewriting a file = %d entries, want 1 expiring at %s", len(w.queue), modified.Add(time.Hour))
+	}
+
+	// Deleting it removes it from the queue
+	for wd, dir := range w.watches {
+		if dir == watchDir {
+			w.handleEvent(inotifyEvent{wd: wd, mask: syscall.IN_DELETE, name: "app.log"})
+		}
+	}
+	if len(w.queue) != 0 || len(w.queued) != 0 {
+		t.Errorf("Queue after deleting the file = %d entries", len(w.queue))
+	}
+}
+
+// TestWatcherLimits tests run limits and the mass-deletion guard in watch mode
+func TestWatcherLimits(t *testing.T) {
+	testRoot := t.TempDir()
+	watchDir := filepath.Join(testRoot, "spool")
+	fillTestDir(t, watchDir, 10, 0, "test content")
+
+	configPath := filepath.Join(testRoot, "filekeeper.yaml")
+	writeConfig := func(settings string) {
+		writeTestFile(t, configPath, fmt.Sprintf(`general:
+  enabled: true
+  logging:
+    enabled: false
+%s
+directories:
+  - path: "%s"
+    retention_period: "7d"
+`, settings, watchDir))
+	}
+
+	// Already expired files that trip the guard are not touched
+	writeConfig("")
+	w := &Watcher{ConfigPath: configPath}
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	w.expire(context.Background(), time.Now())
+	w.Close()
+	if n := countEntries(t, watchDir); n != 10 {
+		t.Fatalf("Watching a directory that trips the mass-deletion guard left %d of 10 files", n)
+	}
+
+	// With --force the guard is off, but the run limits still apply
+	writeConfig("  max_deletions: 2")
+	w = &Watcher{ConfigPath: configPath, Force: true}
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	defer w.Close()
+	w.expire(context.Background(), time.Now())
+	w.expire(context.Background(), time.Now())
+	if n := countEntries(t, watchDir); n != 8 {
+		t.Errorf("Watching with max_deletions: 2 left %d of 10 files, want 8", n)
+	}
+	if w.stopped == nil || w.stopped.Limit != "max_deletions" || len(w.queue) != 8 {
+		t.Errorf("Watcher stopped at %v with %d files queued, want max_deletions and 8", w.stopped, len(w.queue))
+	}
+
+	// A reload starts over
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	w.expire(context.Background(), time.Now())
+	if n := countEntries(t, watchDir); n != 6 {
+		t.Errorf("Watching after a reload left %d files, want 6", n)
+	}
+
+	// Directory limits stop that directory only
+	writeConfig("")
+	configData, _ := os.ReadFile(configPath)
+	writeTestFile(t, configPath, string(configData)+"    max_deletions: 1\n")
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	w.expire(context.Background(), time.Now())
+	if n := countEntries(t, watchDir); n != 5 {
+		t.Errorf("Watching with a directory max_deletions: 1 left %d files, want 5", n)
+	}
+	if w.stopped != nil || w.roots[0].stopped == nil {
+		t.Errorf("Directory limit stopped the watcher (%v) or not the directory (%v)", w.stopped, w.roots[0].stopped)
+	}
+}
+
+// TestWatcherHardlinks tests that the watcher deletes hard links expiring
+// together as one group instead of skipping each for the others
+func TestWatcherHardlinks(t *testing.T) {
+	testRoot, err := os.MkdirTemp("", "filekeeper-watch-links-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testRoot)
+
+	watchDir := filepath.Join(testRoot, "spool")
+	first := writeOldFile(t, filepath.Join(watchDir, "first.log"))
+	second := filepath.Join(watchDir, "sub", "second.log")
+	if err := os.MkdirAll(filepath.Dir(second), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Link(first, second); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
+	}
+	shared := writeOldFile(t, filepath.Join(watchDir, "shared.log"))
+	outside := filepath.Join(testRoot, "outside.log")
+	if err := os.Link(shared, outside); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
+	}
+
+	configPath := writeTestFile(t, filepath.Join(testRoot, "filekeeper.yaml"), fmt.Sprintf(`general:
+  enabled: true
+  logging:
+    enabled: false
+directories:
+  - path: "%s"
+    retention_period: "7d"
+    allow_mass_delete: true
+security:
+  secure_delete:
+    enabled: true
+    passes: 1
+`, watchDir))
+
+	w := &Watcher{ConfigPath: configPath}
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	defer w.Close()
+	w.expire(context.Background(), time.Now())
+
+	// Both links are inside the watched directory, so the file is deleted
+	for _, path := range []string{first, second} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("Hard link %s was not deleted", path)
+		}
+	}
+
+	// A link outside keeps the file under the default skip policy
+	if _, err := os.Lstat(shared); err != nil {
+		t.Error("File with a link outside the directory was deleted")
+	}
+	if data, err := os.ReadFile(outside); err != nil || string(data) != "test content" {
+		t.Errorf("Link outside the directory was changed: %q, %v", data, err)
+	}
+}
+
+// TestCancellation tests that interrupted runs finish or roll back the current file
+func TestCancellation(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "filekeeper-cancel-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+
+	// A cancelled run leaves the files alone and says so
+	oldFile := writeOldFile(t, filepath.Join(testDir, "old.log"))
+	dirConfig := DirectoryConfig{Path: testDir, RetentionPeriod: "7d", AllowMassDelete: true}
+	err = ProcessDirectoryContext(cancelled, dirConfig, SecurityConfig{}, logger)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ProcessDirectoryContext returned %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Error("Cancelled run deleted a file")
+	}
+	if !strings.Contains(logBuf.String(), "Stopped processing directory") {
+		t.Errorf("Cancelled run did not log a summary: %s", logBuf.String())
+	}
+
+	// Directories that were not started are listed
+	err = RunDirectories(cancelled, Config{Directories: []DirectoryConfig{dirConfig}}, logger)
+	if err == nil || !strings.Contains(err.Error(), "not started: "+testDir) {
+		t.Errorf("RunDirectories returned %v, want a summary naming %s", err, testDir)
+	}
+
+	// Overwriting doesn't start once cancelled, and an obfuscated name is rolled back
+	security := SecurityConfig{SecureDelete: SecureDeleteConfig{Enabled: true, Passes: 3, ObfuscateFilenames: true}}
+	removeFile(cancelled, nil, oldFile, true, security, logger)
+	content, err := os.ReadFile(oldFile)
+	if err != nil || string(content) != "test content" {
+		t.Errorf("Interrupted secure delete did not leave the file intact under its name: %q, %v", content, err)
+	}
+	entries, _ := os.ReadDir(testDir)
+	if len(entries) != 1 {
+		t.Errorf("Directory contains %d entries after rollback, want 1", len(entries))
+	}
+
+	// Once a pass is done the file is removed after the current pass
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	passLogger := log.New(writerFunc(func(p []byte) (int, error) {
+		if strings.Contains(string(p), "pass 1/3") {
+			cancel()
+		}
+		return logBuf.Write(p)
+	}), "", 0)
+	if err := shredFile(ctx, nil, oldFile, 3, nil, passLogger); err != nil {
+		t.Errorf("shredFile returned error when interrupted after a pass: %v", err)
+	}
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Error("Partially overwritten file was not removed")
+	}
+	if !strings.Contains(logBuf.String(), "Interrupted after secure delete pass 1/3") {
+		t.Errorf("Interrupted overwrite was not logged: %s", logBuf.String())
+	}
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// TestRunLimits tests the runtime, deletion and size limits
+func TestRunLimits(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "filekeeper-limits-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	// fill creates count old files of 100 bytes in a new subdirectory
+	content := strings.Repeat("x", 100)
+	fill := func(name string, count int) string {
+		return fillTestDir(t, filepath.Join(testDir, name), count, 0, content)
+	}
+
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+
+	// A directory stops after max_deletions files and reports the limit
+	dir := fill("deletions", 10)
+	err = ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d", AllowMassDelete: true, MaxDeletions: 4}, SecurityConfig{}, logger)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "max_deletions" {
+		t.Fatalf("ProcessDirectory returned %v, want a max_deletions LimitError", err)
+	}
+	if n := countEntries(t, dir); n != 6 {
+		t.Errorf("%d files left after max_deletions of 4, want 6", n)
+	}
+	if !strings.Contains(logBuf.String(), "max_deletions limit of 4 reached") {
+		t.Errorf("Reached limit was not logged: %s", logBuf.String())
+	}
+
+	// Exactly max_deletions candidates is within the limit
+	dir = fill("exact", 3)
+	if err := ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d", AllowMassDelete: true, MaxDeletions: 3}, SecurityConfig{}, logger); err != nil {
+		t.Errorf("ProcessDirectory returned %v with candidates equal to max_deletions", err)
+	}
+
+	// max_bytes counts the size of deleted files
+	dir = fill("bytes", 10)
+	err = ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d", AllowMassDelete: true, MaxBytes: "250B"}, SecurityConfig{}, logger)
+	if !errors.As(err, &limitErr) || limitErr.Limit != "max_bytes" {
+		t.Fatalf("ProcessDirectory returned %v, want a max_bytes LimitError", err)
+	}
+	if n := countEntries(t, dir); n != 8 {
+		t.Errorf("%d files left after max_bytes of 250B, want 8", n)
+	}
+
+	// Dry runs count what they would delete
+	dir = fill("dry", 5)
+	err = ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d", AllowMassDelete: true, MaxDeletions: 2}, SecurityConfig{DryRun: true}, logger)
+	if !errors.As(err, &limitErr) {
+		t.Errorf("Dry run returned %v, want a LimitError", err)
+	}
+
+	// A global limit spans directories and skips the ones not started
+	first, second, third := fill("first", 3), fill("second", 3), fill("third", 3)
+	config := Config{
+		General: GeneralConfig{MaxDeletions: 4},
+		Directories: []DirectoryConfig{
+			{Path: first, RetentionPeriod: "7d", AllowMassDelete: true},
+			{Path: second, RetentionPeriod: "7d", AllowMassDelete: true},
+			{Path: third, RetentionPeriod: "7d", AllowMassDelete: true},
+		},
+	}
+	err = RunDirectories(context.Background(), config, logger)
+	if !errors.As(err, &limitErr) || limitErr.Scope != "run" {
+		t.Fatalf("RunDirectories returned %v, want a run LimitError", err)
+	}
+	if !strings.Contains(err.Error(), "not started: "+third) {
+		t.Errorf("RunDirectories error %q does not name the skipped directory", err)
+	}
+	if left := countEntries(t, first) + countEntries(t, second) + countEntries(t, third); left != 5 {
+		t.Errorf("%d files left after a run max_deletions of 4, want 5", left)
+	}
+
+	// A directory limit makes the run fail but lets other directories run
+	limited, other := fill("limited", 3), fill("other", 3)
+	config = Config{Directories: []DirectoryConfig{
+		{Path: limited, RetentionPeriod: "7d", AllowMassDelete: true, MaxDeletions: 1},
+		{Path: other, RetentionPeriod: "7d", AllowMassDelete: true},
+	}}
+	err = RunDirectories(context.Background(), config, logger)
+	if !errors.As(err, &limitErr) || limitErr.Scope != "directory "+limited {
+		t.Errorf("RunDirectories returned %v, want the directory LimitError", err)
+	}
+	if countEntries(t, other) != 0 {
+		t.Error("Directory after a limited one was not processed")
+	}
+
+	// max_runtime cancels the run with the limit as cause
+	budget, err := newRunBudget("run", "1ms", 0, "")
+	if err != nil {
+		t.Fatalf("newRunBudget returned error: %v", err)
+	}
+	ctx, done := budget.begin(context.Background())
+	defer done()
+	<-ctx.Done()
+	if !errors.As(context.Cause(ctx), &limitErr) || limitErr.Limit != "max_runtime" {
+		t.Errorf("Expired budget cause is %v, want a max_runtime LimitError", context.Cause(ctx))
+	}
+	dir = fill("runtime", 3)
+	err = ProcessDirectoryContext(ctx, DirectoryConfig{Path: dir, RetentionPeriod: "7d", AllowMassDelete: true}, SecurityConfig{}, logger)
+	if !errors.As(err, &limitErr) || limitErr.Limit != "max_runtime" {
+		t.Errorf("ProcessDirectoryContext returned %v after max_runtime, want the LimitError", err)
+	}
+	if countEntries(t, dir) != 3 {
+		t.Error("Files were deleted after max_runtime")
+	}
+
+	// Limits are validated
+	if _, err := newRunBudget("run", "soon", 0, ""); err == nil {
+		t.Error("newRunBudget accepted an invalid max_runtime")
+	}
+	problems := validateConfigData("filekeeper.yaml", []byte(`general:
+  max_runtime: "soon"
+  max_deletions: -1
+directories:
+  - path: "/tmp"
+    retention_period: "7d"
+    max_bytes: "lots"
+`))
+	if len(problems) != 3 {
+		t.Errorf("validateConfigData found %d problems, want 3: %v", len(problems), problems)
+	}
+}
+
+// TestMassDeleteGuard tests refusing to delete most of a directory
+func TestMassDeleteGuard(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "filekeeper-mass-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	// fill creates old and new files in a new subdirectory
+	fill := func(name string, old, recent int) string {
+		return fillTestDir(t, filepath.Join(testDir, name), old, recent, "test content")
+	}
+
+	logger := log.New(io.Discard, "", 0)
+
+	// 10 of 11 files expired is refused, also in dry-run mode
+	dir := fill("refused", 10, 1)
+	for _, security := range []SecurityConfig{{DryRun: true}, {}} {
+		err = ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d"}, security, logger)
+		var massErr *MassDeleteError
+		if !errors.As(err, &massErr) || massErr.Candidates != 10 || massErr.Total != 11 {
+			t.Fatalf("ProcessDirectory returned %v, want a MassDeleteError for 10 of 11 files", err)
+		}
+	}
+	if n := countEntries(t, dir); n != 11 {
+		t.Errorf("Refused directory has %d files left, want 11", n)
+	}
+
+	// A higher threshold lets the same directory through
+	if err := ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d", MassDeletePercent: 95}, SecurityConfig{}, logger); err != nil {
+		t.Errorf("ProcessDirectory returned %v with mass_delete_percent 95", err)
+	}
+	if n := countEntries(t, dir); n != 1 {
+		t.Errorf("%d files left with mass_delete_percent 95, want 1", n)
+	}
+
+	// allow_mass_delete, set by --force, turns the guard off
+	dir = fill("allowed", 12, 0)
+	config := Config{Directories: []DirectoryConfig{{Path: dir, RetentionPeriod: "7d"}}}
+	applyForce(&config)
+	if err := ProcessDirectory(config.Directories[0], SecurityConfig{}, logger); err != nil {
+		t.Errorf("ProcessDirectory returned %v with allow_mass_delete", err)
+	}
+	if n := countEntries(t, dir); n != 0 {
+		t.Errorf("%d files left with allow_mass_delete, want 0", n)
+	}
+
+	// Small directories are protected too, down to a single file
+	for _, old := range []int{1, 3} {
+		dir = fill(fmt.Sprintf("small%d", old), old, 0)
+		err = ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d"}, SecurityConfig{}, logger)
+		var massErr *MassDeleteError
+		if !errors.As(err, &massErr) || massErr.Candidates != old {
+			t.Errorf("ProcessDirectory returned %v for %d of %d files expired, want a MassDeleteError", err, old, old)
+		}
+		if n := countEntries(t, dir); n != old {
+			t.Errorf("Small directory has %d files left, want %d", n, old)
+		}
+	}
+
+	// ...unless fewer files than mass_delete_min_files would be deleted
+	dir = fill("minimum", 3, 0)
+	if err := ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d", MassDeleteMinFiles: 4}, SecurityConfig{}, logger); err != nil {
+		t.Errorf("ProcessDirectory returned %v for 3 expired files with mass_delete_min_files 4", err)
+	}
+	if n := countEntries(t, dir); n != 0 {
+		t.Errorf("%d files left with mass_delete_min_files 4, want 0", n)
+	}
+	dir = fill("minimum-reached", 4, 0)
+	err = ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d", MassDeleteMinFiles: 4}, SecurityConfig{}, logger)
+	if !errors.As(err, new(*MassDeleteError)) {
+		t.Errorf("ProcessDirectory returned %v for 4 expired files with mass_delete_min_files 4, want a MassDeleteError", err)
+	}
+
+	// The pattern defines the files counted
+	dir = fill("pattern", 10, 0)
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("keep%d.dat", i)), []byte("test content"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	err = ProcessDirectory(DirectoryConfig{Path: dir, RetentionPeriod: "7d", FilePattern: "*.log"}, SecurityConfig{}, logger)
+	var massErr *MassDeleteError
+	if !errors.As(err, &massErr) || massErr.Total != 10 {
+		t.Errorf("ProcessDirectory returned %v, want a MassDeleteError counting only *.log files", err)
+	}
+
+	// The threshold is a percentage
+	problems := validateConfigData("filekeeper.yaml", []byte(`directories:
+  - path: "/tmp"
+    retention_period: "7d"
+    mass_delete_percent: 150
+`))
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "mass_delete_percent") {
+		t.Errorf("validateConfigData returned %v, want a mass_delete_percent problem", problems)
+	}
+	problems = validateConfigData("filekeeper.yaml", []byte(`directories:
+  - path: "/tmp"
+    retention_period: "7d"
+    mass_delete_min_files: -1
+`))
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "mass_delete_min_files") {
+		t.Errorf("validateConfigData returned %v, want a mass_delete_min_files problem", problems)
+	}
+}
+
+// TestProtectedPaths tests refusing protected directories at load time
+func TestProtectedPaths(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "filekeeper-protected-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	for _, name := range []string{"protected/sub", "other", "home"} {
+		if err := os.MkdirAll(filepath.Join(testDir, name), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	if err := os.Symlink("/etc", filepath.Join(testDir, "etc-link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	t.Setenv("HOME", filepath.Join(testDir, "home"))
+
+	configPath := filepath.Join(testDir, "filekeeper.yaml")
+	load := func(general, entry string) error {
+		config := "general:\n  enabled: true\n" + general + "directories:\n  - retention_period: \"7d\"\n" + entry
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		_, err := LoadConfig(configPath)
+		return err
+	}
+	protected := "  protected_paths:\n    - \"" + filepath.Join(testDir, "protected") + "\"\n"
+
+	tests := []struct {
+		name    string
+		general string
+		entry   string
+		wantErr string
+	}{
+		{"root", "", "    path: \"/\"\n", "/ is a protected system directory"},
+		{"etc", "", "    path: \"/etc/\"\n", "/etc/ is a protected system directory"},
+		{"home directories", "", "    path: \"/home/someone\"\n", "protected system directory"},
+		{"symlink", "", "    path: \"" + testDir + "/etc-link\"\n", "resolves to /etc"},
+		{"own home", "", "    path: \"~\"\n", "is the home directory"},
+		{"inside /var", "", "    path: \"/var/log/app\"\n", ""},
+		{"override", "", "    path: \"/\"\n    allow_protected_path: true\n", ""},
+		{"protected path", protected, "    path: \"" + testDir + "/protected\"\n", "overlaps protected path"},
+		{"inside protected path", protected, "    path: \"" + testDir + "/protected/sub\"\n", "overlaps protected path"},
+		{"containing protected path", protected, "    path: \"" + testDir + "\"\n", "overlaps protected path"},
+		{"glob match", protected, "    path: \"" + testDir + "/pro*\"\n", "overlaps protected path"},
+		{"unrelated", protected, "    path: \"" + testDir + "/other\"\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := load(tt.general, tt.entry)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("LoadConfig returned error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "allow_protected_path") {
+				t.Errorf("LoadConfig returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Relative paths are checked by where they point from the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	defer os.Chdir(wd)
+	relativeProtected := "  protected_paths:\n    - \"protected\"\n"
+	for _, tt := range []struct {
+		cwd, general, path, wantErr string
+	}{
+		{"/", "", "./", "./ (resolves to /) is a protected system directory"},
+		{"/usr", "", "..", "resolves to /)"},
+		{filepath.Join(testDir, "other"), "", strings.Repeat("../", 32) + "etc", "resolves to /etc)"},
+		{testDir, protected, "protected/sub", "overlaps protected path"},
+		{testDir, relativeProtected, testDir + "/protected/sub", "overlaps protected path " + testDir + "/protected"},
+		{testDir, relativeProtected, "other", ""},
+	} {
+		if err := os.Chdir(tt.cwd); err != nil {
+			t.Fatalf("Failed to change directory: %v", err)
+		}
+		err := load(tt.general, "    path: \""+tt.path+"\"\n")
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("LoadConfig of %s in %s returned error: %v", tt.path, tt.cwd, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("LoadConfig of %s in %s returned %v, want an error containing %q", tt.path, tt.cwd, err, tt.wantErr)
+		}
+	}
+	os.Chdir(wd)
+
+	// validate reports protected paths, also in profiles
+	config := "directories:\n  - path: \"" + testDir + "/other\"\n    retention_period: \"7d\"\nprofiles:\n  wrong:\n    directories:\n      - path: \"/usr\"\n        retention_period: \"7d\"\n"
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	problems := ValidateConfig(configPath)
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "profile wrong: directories[0].path: /usr is a protected system directory") {
+		t.Errorf("ValidateConfig returned %v, want the protected path in profile wrong", problems)
+	}
+
+	// Directories created after loading are checked when a run expands a pattern
+	srvDir := filepath.Join(testDir, "srv")
+	appFile := writeOldFile(t, filepath.Join(srvDir, "app", "app.log"))
+	dbFile := writeOldFile(t, filepath.Join(srvDir, "db", "data.db"))
+	runConfig := Config{
+		General:     GeneralConfig{ProtectedPaths: []string{filepath.Join(srvDir, "db")}},
+		Directories: []DirectoryConfig{{Path: filepath.Join(srvDir, "*"), RetentionPeriod: "7d", AllowMassDelete: true}},
+	}
+	logger := log.New(io.Discard, "", 0)
+	if err := RunDirectories(context.Background(), runConfig, logger); err != nil {
+		t.Fatalf("RunDirectories returned error: %v", err)
+	}
+	if _, err := os.Stat(dbFile); err != nil {
+		t.Error("Run deleted a file in a protected directory matching a pattern")
+	}
+	if _, err := os.Stat(appFile); !os.IsNotExist(err) {
+		t.Error("Run did not process an unprotected match of the pattern")
+	}
+
+	// ... and when watch mode finds a new subdirectory
+	watchDir := filepath.Join(testDir, "spool")
+	os.MkdirAll(watchDir, 0755)
+	watchConfig := writeTestFile(t, filepath.Join(testDir, "watch.yaml"), fmt.Sprintf(`general:
+  enabled: true
+  logging:
+    enabled: false
+  protected_paths:
+    - "%s/*/keep"
+directories:
+  - path: "%s"
+    retention_period: "7d"
+    allow_mass_delete: true
+`, watchDir, watchDir))
+	w := &Watcher{ConfigPath: watchConfig}
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	defer w.Close()
+	keptFile := writeOldFile(t, filepath.Join(watchDir, "new", "keep", "data.log"))
+	newFile := writeOldFile(t, filepath.Join(watchDir, "new", "other.log"))
+	if err := w.addDirectory(w.roots[0], filepath.Join(watchDir, "new")); err != nil {
+		t.Fatalf("addDirectory returned error: %v", err)
+	}
+	w.expire(context.Background(), time.Now())
+	if _, err := os.Stat(keptFile); err != nil {
+		t.Error("Watch mode deleted a file in a protected subdirectory created after loading")
+	}
+	if _, err := os.Stat(newFile); !os.IsNotExist(err) {
+		t.Error("Watch mode did not delete a file in a new subdirectory")
+	}
+}
+
+// TestSafeTree tests that deletions can't be redirected through symbolic links
+func TestSafeTree(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "filekeeper-tree-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+
+	// A root that is a symbolic link is resolved once and processed
+	realDir := filepath.Join(testDir, "realDir")
+	writeOldFile(t, filepath.Join(realDir, "old.log"))
+	link := filepath.Join(testDir, "link")
+	if err := os.Symlink(realDir, link); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := ProcessDirectory(DirectoryConfig{Path: link, RetentionPeriod: "7d", AllowMassDelete: true}, SecurityConfig{}, logger); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(realDir, "old.log")); !os.IsNotExist(err) {
+		t.Error("File in the resolved directory was not deleted")
+	}
+	if !strings.Contains(logBuf.String(), "Directory "+link+" resolves to "+realDir) {
+		t.Errorf("Resolved root was not logged: %s", logBuf.String())
+	}
+
+	// A directory swapped for a symbolic link after the walk doesn't
+	// redirect the deletion, whichever way the file is deleted
+	securities := map[string]SecurityConfig{
+		"plain":     {},
+		"obfuscate": {SecureDelete: SecureDeleteConfig{ObfuscateFilenames: true}},
+		"shred":     {SecureDelete: SecureDeleteConfig{Enabled: true, Passes: 1}},
+	}
+	for name, security := range securities {
+		t.Run(name, func(t *testing.T) {
+			root := filepath.Join(testDir, "swap-"+name)
+			outside := filepath.Join(testDir, "outside-"+name)
+			writeOldFile(t, filepath.Join(root, "sub", "old.log"))
+			writeOldFile(t, filepath.Join(outside, "old.log"))
+
+			testHookBeforeDelete = func(path string) {
+				sub := filepath.Join(root, "sub")
+				if err := os.Rename(sub, sub+".moved"); err != nil {
+					t.Fatalf("Failed to move directory: %v", err)
+				}
+				if err := os.Symlink(outside, sub); err != nil {
+					t.Fatalf("Failed to create symlink: %v", err)
+				}
+			}
+			defer func() { testHookBeforeDelete = nil }()
+
+			logBuf.Reset()
+			if err := ProcessDirectory(DirectoryConfig{Path: root, RetentionPeriod: "7d", AllowMassDelete: true}, security, logger); err != nil {
+				t.Fatalf("ProcessDirectory returned error: %v", err)
+			}
+			content, err := os.ReadFile(filepath.Join(outside, "old.log"))
+			if err != nil || string(content) != "test content" {
+				t.Errorf("File outside the tree was touched: %q, %v", content, err)
+			}
+			if !strings.Contains(logBuf.String(), errLeavesTree.Error()) {
+				t.Errorf("Refused deletion was not logged: %s", logBuf.String())
+			}
+		})
+	}
+
+	// Paths outside the tree are refused
+	tree, err := openSafeTree(realDir)
+	if err != nil {
+		t.Fatalf("openSafeTree returned error: %v", err)
+	}
+	defer tree.Close()
+	outsideFile := filepath.Join(testDir, "outside.log")
+	writeOldFile(t, outsideFile)
+	for _, path := range []string{outsideFile, realDir, filepath.Join(realDir, "..", "outside.log")} {
+		if err := tree.Remove(path); !errors.Is(err, errLeavesTree) {
+			t.Errorf("Remove(%s) returned %v, want errLeavesTree", path, err)
+		}
+	}
+	if _, err := os.Stat(outsideFile); err != nil {
+		t.Error("File outside the tree was removed")
+	}
+
+	// Secure deletion of a symbolic link removes the link, not its target
+	target := filepath.Join(testDir, "target.log")
+	writeOldFile(t, target)
+	if err := os.Symlink(target, filepath.Join(realDir, "link.log")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	security := SecurityConfig{SecureDelete: SecureDeleteConfig{Enabled: true, Passes: 1}}
+	removeFile(context.Background(), tree, filepath.Join(realDir, "link.log"), true, security, logger)
+	if _, err := os.Lstat(filepath.Join(realDir, "link.log")); !os.IsNotExist(err) {
+		t.Error("Symbolic link was not removed")
+	}
+	if content, err := os.ReadFile(target); err != nil || string(content) != "test content" {
+		t.Errorf("Target of a symbolic link was overwritten: %q, %v", content, err)
+	}
+}
+
+// TestOneFileSystem tests skipping subtrees on other filesystems
+func TestOneFileSystem(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "filekeeper-onefs-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	// Directories named mnt are on another device
+	realDeviceOf := deviceOf
+	deviceOf = func(info os.FileInfo) uint64 {
+		if info.Name() == "mnt" {
+			return 1<<64 - 1
+		}
+		return realDeviceOf(info)
+	}
+	defer func() { deviceOf = realDeviceOf }()
+
+	oldTime := time.Now().Add(-10 * 24 * time.Hour)
+	setup := func() {
+		for _, dir := range []string{"keep", "mnt/empty", "empty"} {
+			if err := os.MkdirAll(filepath.Join(testDir, dir), 0755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+		}
+		for _, name := range []string{"keep/old.log", "mnt/old.log"} {
+			path := filepath.Join(testDir, name)
+			if err := os.WriteFile(path, []byte("test content"), 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+			if err := os.Chtimes(path, oldTime, oldTime); err != nil {
+				t.Fatalf("Failed to set file time: %v", err)
+			}
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(testDir, name))
+		return err == nil
+	}
+
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+
+	// The mount point is skipped by both passes and reported
+	setup()
+	dirConfig := DirectoryConfig{Path: testDir, RetentionPeriod: "7d", RemoveEmptyDirs: true, OneFileSystem: true, AllowMassDelete: true}
+	if err := ProcessDirectory(dirConfig, SecurityConfig{}, logger); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+	if exists("keep/old.log") || exists("empty") {
+		t.Error("Files on the root's filesystem were not processed")
+	}
+	if !exists("mnt/old.log") || !exists("mnt/empty") {
+		t.Error("Files on another filesystem were processed")
+	}
+	mnt := filepath.Join(testDir, "mnt")
+	if !strings.Contains(logBuf.String(), "Skipping mount point "+mnt) || !strings.Contains(logBuf.String(), "Skipped 1 mount points in "+testDir) {
+		t.Errorf("Skipped mount point was not reported: %s", logBuf.String())
+	}
+
+	// Without the option other filesystems are processed as before
+	setup()
+	dirConfig.OneFileSystem = false
+	if err := ProcessDirectory(dirConfig, SecurityConfig{}, logger); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+	if exists("mnt/old.log") || exists("mnt/empty") {
+		t.Error("Files on another filesystem were not processed without one_file_system")
+	}
+}
+
+// TestPlanApply tests recording a plan and applying it
+func TestPlanApply(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "filekeeper-plan-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	names := []string{"unchanged.log", "modified.log", "replaced.log", "gone.log"}
+	for _, name := range names {
+		writeOldFile(t, filepath.Join(testDir, name))
+	}
+	if err := os.WriteFile(filepath.Join(testDir, "new.log"), []byte("test content"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	// Planning records the expired files and deletes nothing
+	logger := log.New(io.Discard, "", 0)
+	config := Config{Directories: []DirectoryConfig{{Path: testDir, RetentionPeriod: "7d"}}}
+	plan, err := MakePlan(context.Background(), config, logger)
+	if err != nil {
+		t.Fatalf("MakePlan returned error: %v", err)
+	}
+	if len(plan.Directories) != 1 || len(plan.Directories[0].Files) != 4 {
+		t.Fatalf("MakePlan recorded %+v, want 4 files in one directory", plan.Directories)
+	}
+	if rule := plan.Directories[0].Rule; rule != "retention_period 7d" {
+		t.Errorf("Plan rule = %q", rule)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(testDir, name)); err != nil {
+			t.Errorf("Planning deleted %s", name)
+		}
+	}
+
+	// The plan survives the round trip through its file
+	data, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("Failed to encode plan: %v", err)
+	}
+	plan = &Plan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		t.Fatalf("Failed to decode plan: %v", err)
+	}
+
+	// Change the files after planning
+	later := oldTestTime.Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(testDir, "modified.log"), later, later); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+	replacement := writeOldFile(t, filepath.Join(testDir, "replacement.tmp"))
+	if err := os.Rename(replacement, filepath.Join(testDir, "replaced.log")); err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+	if err := os.Remove(filepath.Join(testDir, "gone.log")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	// A dry run checks the plan without deleting
+	result := ApplyPlan(context.Background(), plan, config, true, logger)
+	if result != (ApplyResult{Deleted: 1, Refused: 2, Missing: 1}) {
+		t.Errorf("ApplyPlan dry run = %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(testDir, "unchanged.log")); err != nil {
+		t.Error("Dry run deleted a file")
+	}
+
+	// Only unchanged files are deleted
+	result = ApplyPlan(context.Background(), plan, config, false, logger)
+	if result != (ApplyResult{Deleted: 1, Refused: 2, Missing: 1}) {
+		t.Errorf("ApplyPlan = %+v", result)
+	}
+	for name, want := range map[string]bool{"unchanged.log": false, "modified.log": true, "replaced.log": true, "new.log": true} {
+		if _, err := os.Stat(filepath.Join(testDir, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v after applying, want %v", name, err == nil, want)
+		}
+	}
+
+	// A directory that now resolves elsewhere is refused as a whole
+	moved := testDir + ".moved"
+	if err := os.Rename(testDir, moved); err != nil {
+		t.Fatalf("Failed to move directory: %v", err)
+	}
+	defer os.RemoveAll(moved)
+	if err := os.Symlink(moved, testDir); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Chtimes(filepath.Join(moved, "modified.log"), oldTestTime, oldTestTime); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+	plan.Directories[0].Files = plan.Directories[0].Files[1:2]
+	result = ApplyPlan(context.Background(), plan, config, false, logger)
+	if result != (ApplyResult{Refused: 1}) {
+		t.Errorf("ApplyPlan on a swapped directory = %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(moved, "modified.log")); err != nil {
+		t.Error("File was deleted through a swapped directory")
+	}
+
+	// A tampered plan can't reach files outside the configured directories,
+	// or protected ones inside them
+	configured := filepath.Join(moved, "configured")
+	outside := writeOldFile(t, filepath.Join(moved, "outside", "victim.log"))
+	allowed := writeOldFile(t, filepath.Join(configured, "allowed.log"))
+	secret := writeOldFile(t, filepath.Join(configured, "keep", "secret.log"))
+	planFile := func(path string) PlanFile {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", path, err)
+		}
+		return newPlanFile(path, info)
+	}
+	config = Config{Directories: []DirectoryConfig{{Path: configured, RetentionPeriod: "7d"}}}
+	tampered := &Plan{Directories: []*PlanDirectory{
+		{Path: filepath.Dir(outside), Files: []PlanFile{planFile(outside)}},
+		{Path: configured, Files: []PlanFile{
+			planFile(allowed),
+			planFile(outside),
+			{Path: configured + "/../outside/victim.log"},
+		}},
+	}}
+	var logBuf bytes.Buffer
+	result = ApplyPlan(context.Background(), tampered, config, false, log.New(&logBuf, "", 0))
+	if result != (ApplyResult{Deleted: 1, Refused: 3}) {
+		t.Errorf("ApplyPlan of a tampered plan = %+v", result)
+	}
+
+	// Protected paths are checked against the current configuration
+	config.General.ProtectedPaths = []string{filepath.Join(configured, "keep")}
+	tampered = &Plan{Directories: []*PlanDirectory{
+		{Path: filepath.Join(configured, "keep"), Files: []PlanFile{planFile(secret)}},
+	}}
+	result = ApplyPlan(context.Background(), tampered, config, false, log.New(&logBuf, "", 0))
+	if result != (ApplyResult{Refused: 1}) {
+		t.Errorf("ApplyPlan of a plan for a protected path = %+v", result)
+	}
+
+	// Deletion settings are taken from the configuration, not the plan
+	config.General.ProtectedPaths = nil
+	config.Directories[0].QuarantinePeriod = "7d"
+	kept := writeOldFile(t, filepath.Join(configured, "kept.log"))
+	tampered = &Plan{Directories: []*PlanDirectory{
+		{Path: configured, Files: []PlanFile{planFile(kept)}},
+	}}
+	result = ApplyPlan(context.Background(), tampered, config, false, log.New(&logBuf, "", 0))
+	if result != (ApplyResult{Deleted: 1}) {
+		t.Errorf("ApplyPlan of a plan without quarantine = %+v", result)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(configured, quarantineDirName, "*", "kept.log")); len(matches) != 1 {
+		t.Error("File of a plan without quarantine was not quarantined")
+	}
+
+	for path, want := range map[string]bool{allowed: false, secret: true, outside: true, kept: false} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("%s exists = %v after applying a tampered plan, want %v", path, err == nil, want)
+		}
+	}
+	for _, want := range []string{"is not below a directory of the configuration", "is not inside directory", "overlaps protected path", "differ from the plan"} {
+		if !strings.Contains(logBuf.String(), want) {
+			t.Errorf("Refusals do not mention %q: %s", want, logBuf.String())
+		}
+	}
+}
+
+// TestQuarantine tests that expired files are quarantined, purged after the
+// grace period and can be restored
+func TestQuarantine(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "filekeeper-quarantine-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	oldFile := writeOldFile(t, filepath.Join(testDir, "old.log"))
+	nestedFile := writeOldFile(t, filepath.Join(testDir, "sub", "nested.log"))
+
+	// Expired files are moved into a batch, keeping their relative paths
+	logger := log.New(io.Discard, "", 0)
+	dirConfig := DirectoryConfig{Path: testDir, RetentionPeriod: "7d", QuarantinePeriod: "7d", RemoveEmptyDirs: true, AllowMassDelete: true}
+	if err := ProcessDirectory(dirConfig, SecurityConfig{}, logger); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+	for _, path := range []string{oldFile, nestedFile} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not moved into the quarantine", path)
+		}
+	}
+	tree, err := openSafeTree(testDir)
+	if err != nil {
+		t.Fatalf("openSafeTree returned error: %v", err)
+	}
+	defer tree.Close()
+	q := newQuarantine(tree, 7*24*time.Hour)
+	files, err := q.list()
+	if err != nil {
+		t.Fatalf("list returned error: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("list returned %+v, want 2 files", files)
+	}
+	for _, file := range files {
+		if file.Path != oldFile && file.Path != nestedFile {
+			t.Errorf("Quarantined file has original path %s", file.Path)
+		}
+		rel, _ := filepath.Rel(testDir, file.Path)
+		if batch := filepath.Dir(filepath.Clean(strings.TrimSuffix(file.Stored, rel))); batch != q.dir {
+			t.Errorf("Quarantined file %s stored at %s", file.Path, file.Stored)
+		}
+	}
+
+	// The quarantine is not scanned again, and is not purged early
+	if err := ProcessDirectory(dirConfig, SecurityConfig{}, logger); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+	if files, _ := q.list(); len(files) != 2 {
+		t.Errorf("Second run left %d quarantined files, want 2", len(files))
+	}
+
+	// Restoring puts the file back, but never over another one
+	var restored quarantinedFile
+	for _, file := range files {
+		if file.Path == nestedFile {
+			restored = file
+		}
+	}
+	if err := q.restore(restored, true); err != nil {
+		t.Fatalf("restore returned error: %v", err)
+	}
+	info, err := os.Stat(nestedFile)
+	if err != nil {
+		t.Fatalf("Restored file is missing: %v", err)
 	}
-
-	// Create the files
-	for _, file := range []string{oldFile, newFile, nonMatchingFile, oldSubFile} {
-		if err := os.WriteFile(file, []byte("test content"), 0644); err != nil {
-			t.Fatalf("Failed to create test file %s: %v", file, err)
+	if time.Since(info.ModTime()) > time.Minute {
+		t.Errorf("Restored file has modification time %s, want now", info.ModTime())
+	}
+	if _, err := os.Stat(filepath.Dir(restored.Stored)); !os.IsNotExist(err) {
+		t.Error("Empty directory of the batch was not removed after restoring")
+	}
+	for _, file := range files {
+		if file.Path == oldFile {
+			writeOldFile(t, filepath.Join(testDir, "old.log"))
+			if err := q.restore(file, false); err == nil {
+				t.Error("restore overwrote an existing file")
+			}
+			os.Remove(oldFile)
 		}
 	}
 
-	// Set modification times (old files: 10 days ago, new files: now)
-	oldTime := time.Now().Add(-10 * 24 * time.Hour)
-	if err := os.Chtimes(oldFile, oldTime, oldTime); err != nil {
-		t.Fatalf("Failed to set old file time: %v", err)
+	// Batches are purged once the grace period has passed
+	q.purge(context.Background(), time.Now().Add(24*time.Hour), SecurityConfig{}, logger)
+	if files, _ := q.list(); len(files) != 1 {
+		t.Errorf("Early purge left %d quarantined files, want 1", len(files))
 	}
-	if err := os.Chtimes(oldSubFile, oldTime, oldTime); err != nil {
-		t.Fatalf("Failed to set old subdir file time: %v", err)
+	q.purge(context.Background(), time.Now().Add(8*24*time.Hour), SecurityConfig{}, logger)
+	if files, _ := q.list(); len(files) != 0 {
+		t.Errorf("Purge left %d quarantined files", len(files))
 	}
-
-	// Create a test logger
-	logger := log.New(io.Discard, "", 0)
-
-	// Test case 1: Process with pattern matching and include subdirs in dry run mode
-	dirConfig := DirectoryConfig{
-		Path:            testRoot,
-		RetentionPeriod: "7d",
-		FilePattern:     "*.log",
-		ExcludeSubdirs:  false,
-		RemoveEmptyDirs: true,
+	if _, err := os.Stat(filepath.Join(testDir, quarantineDirName)); !os.IsNotExist(err) {
+		t.Error("Empty quarantine was not removed")
 	}
-	securityConfig := SecurityConfig{
-		DryRun: true, // Use dry run for testing
-		SecureDelete: SecureDeleteConfig{
-			Enabled:            false,
-			Passes:             1,
-			ObfuscateFilenames: false,
-		},
+	if _, err := os.Stat(nestedFile); err != nil {
+		t.Error("Purge deleted a restored file")
 	}
 
-	// Process the directory
-	err = ProcessDirectory(dirConfig, securityConfig, logger)
+	// Plans record the quarantine period, and applying them quarantines
+	writeOldFile(t, filepath.Join(testDir, "planned.log"))
+	plan, err := MakePlan(context.Background(), Config{Directories: []DirectoryConfig{dirConfig}}, logger)
 	if err != nil {
-		t.Errorf("ProcessDirectory returned error: %v", err)
+		t.Fatalf("MakePlan returned error: %v", err)
 	}
-
-	// Verify old files are still there (because we used dry run)
-	if _, err := os.Stat(oldFile); os.IsNotExist(err) {
-		t.Errorf("Old file was deleted despite dry run mode")
+	if len(plan.Directories) != 1 || plan.Directories[0].QuarantinePeriod != "7d" {
+		t.Fatalf("MakePlan recorded %+v", plan.Directories)
 	}
-	if _, err := os.Stat(oldSubFile); os.IsNotExist(err) {
-		t.Errorf("Old subdirectory file was deleted despite dry run mode")
+	if result := ApplyPlan(context.Background(), plan, Config{Directories: []DirectoryConfig{dirConfig}}, false, logger); result.Deleted != 1 {
+		t.Errorf("ApplyPlan = %+v", result)
 	}
-	if _, err := os.Stat(emptySubDir); os.IsNotExist(err) {
-		t.Errorf("Empty directory was deleted despite dry run mode")
+	if files, _ := q.list(); len(files) != 1 || files[0].Path != filepath.Join(testDir, "planned.log") {
+		t.Errorf("Applying the plan quarantined %+v", files)
 	}
+}
 
-	// Test case 2: Process with subdirs excluded and actual deletion
-	dirConfig.ExcludeSubdirs = true
-	dirConfig.RetentionPeriod = "7d"
-	securityConfig.DryRun = false
-
-	err = ProcessDirectory(dirConfig, securityConfig, logger)
+// TestQuarantineHardlinks tests purging hard links quarantined in one batch
+func TestQuarantineHardlinks(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "filekeeper-quarantine-hardlink-test")
 	if err != nil {
-		t.Errorf("ProcessDirectory returned error: %v", err)
+		t.Fatalf("Failed to create temp directory: %v", err)
 	}
+	defer os.RemoveAll(testDir)
 
-	// Verify old root file is gone, but subdirectory file remains
-	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
-		t.Errorf("Old file still exists after processing with delete enabled")
+	first := writeOldFile(t, filepath.Join(testDir, "first.log"))
+	second := filepath.Join(testDir, "sub", "second.log")
+	os.MkdirAll(filepath.Dir(second), 0755)
+	if err := os.Link(first, second); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
 	}
-	if _, err := os.Stat(oldSubFile); os.IsNotExist(err) {
-		t.Errorf("Subdirectory file was deleted despite exclude_subdirs being true")
+	outside := filepath.Join(t.TempDir(), "outside.log")
+
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+	security := SecurityConfig{SecureDelete: SecureDeleteConfig{Enabled: true, Passes: 1}}
+	dirConfig := DirectoryConfig{Path: testDir, RetentionPeriod: "7d", QuarantinePeriod: "7d", AllowMassDelete: true}
+	if err := ProcessDirectory(dirConfig, security, logger); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+	tree, err := openSafeTree(testDir)
+	if err != nil {
+		t.Fatalf("openSafeTree returned error: %v", err)
+	}
+	defer tree.Close()
+	q := newQuarantine(tree, 7*24*time.Hour)
+	files, err := q.list()
+	if err != nil || len(files) != 2 {
+		t.Fatalf("list returned %+v, %v, want 2 files", files, err)
 	}
 
-	// Make sure the new and non-matching files still exist
-	if _, err := os.Stat(newFile); os.IsNotExist(err) {
-		t.Errorf("New file was incorrectly deleted")
+	// A link outside the batch keeps it under the default policy
+	if err := os.Link(files[0].Stored, outside); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
 	}
-	if _, err := os.Stat(nonMatchingFile); os.IsNotExist(err) {
-		t.Errorf("Non-matching file was incorrectly deleted")
+	logBuf.Reset()
+	q.purge(context.Background(), time.Now().Add(8*24*time.Hour), security, logger)
+	if files, _ := q.list(); len(files) != 2 {
+		t.Errorf("Purge left %d quarantined files, want 2", len(files))
+	}
+	if !strings.Contains(logBuf.String(), "removed 0 of 2 files") || strings.Contains(logBuf.String(), "Purged") {
+		t.Errorf("Purge of a kept batch logged:\n%s", logBuf.String())
 	}
 
-	// Test case 3: Process with empty directory removal
-	// First, make sure empty directory still exists
-	if _, err := os.Stat(emptySubDir); os.IsNotExist(err) {
-		// Recreate if it was deleted
-		if err := os.Mkdir(emptySubDir, 0755); err != nil {
-			t.Fatalf("Failed to recreate empty subdirectory: %v", err)
+	// Links that are all in the batch are purged together
+	os.Remove(outside)
+	logBuf.Reset()
+	q.purge(context.Background(), time.Now().Add(8*24*time.Hour), security, logger)
+	for _, file := range files {
+		if _, err := os.Lstat(file.Stored); !os.IsNotExist(err) {
+			t.Errorf("Purge left %s", file.Stored)
 		}
 	}
+	if _, err := os.Stat(q.dir); !os.IsNotExist(err) {
+		t.Errorf("Quarantine was not removed, log:\n%s", logBuf.String())
+	}
+	if !strings.Contains(logBuf.String(), "All 2 hard links") || !strings.Contains(logBuf.String(), ": 2 files quarantined") {
+		t.Errorf("Purge logged:\n%s", logBuf.String())
+	}
+}
 
-	dirConfig.ExcludeSubdirs = false
-	dirConfig.RemoveEmptyDirs = true
-
-	err = ProcessDirectory(dirConfig, securityConfig, logger)
+// TestRunDirectories tests processing directory entries in parallel
+func TestRunDirectories(t *testing.T) {
+	// Overlapping entries are grouped in configuration order
+	groups := overlappingGroups([]DirectoryConfig{
+		{Path: "/srv/a"},
+		{Path: "/srv/b"},
+		{Path: "/srv/a/cache"},
+		{Path: "/srv/*/logs"},
+		{Path: "/var/tmp"},
+		{Path: "/srv/ab"},
+	})
+	expected := [][]int{{0, 1, 2, 3, 5}, {4}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("overlappingGroups() = %v, want %v", groups, expected)
+	}
+	groups = overlappingGroups([]DirectoryConfig{{Path: "/srv/a"}, {Path: "/srv/ab"}, {Path: "/srv/a/"}})
+	expected = [][]int{{0, 2}, {1}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("overlappingGroups() = %v, want %v", groups, expected)
+	}
+
+	testRoot, err := os.MkdirTemp("", "filekeeper-parallel-test")
 	if err != nil {
-		t.Errorf("ProcessDirectory returned error: %v", err)
+		t.Fatalf("Failed to create temp directory: %v", err)
 	}
+	defer os.RemoveAll(testRoot)
 
-	// Verify empty directory was removed
-	if _, err := os.Stat(emptySubDir); !os.IsNotExist(err) {
-		t.Errorf("Empty directory still exists after processing with remove_empty_dirs=true")
+	oldTime := time.Now().Add(-10 * 24 * time.Hour)
+	var dirs []DirectoryConfig
+	var oldFiles []string
+	for _, name := range []string{"one", "two", "three", "three/nested"} {
+		dir := filepath.Join(testRoot, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		oldFile := filepath.Join(dir, "old.log")
+		if err := os.WriteFile(oldFile, []byte("test content"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		if err := os.Chtimes(oldFile, oldTime, oldTime); err != nil {
+			t.Fatalf("Failed to set file time: %v", err)
+		}
+		oldFiles = append(oldFiles, oldFile)
+		dirs = append(dirs, DirectoryConfig{Path: dir, RetentionPeriod: "7d", ExcludeSubdirs: true, AllowMassDelete: true})
 	}
+	dirs = append(dirs, DirectoryConfig{Path: filepath.Join(testRoot, "missing"), RetentionPeriod: "7d"})
 
-	// Test case 4: Test with a non-existent directory
-	dirConfig.Path = "/non-existent-dir-for-test"
-	err = ProcessDirectory(dirConfig, securityConfig, logger)
-	if err == nil {
-		t.Errorf("ProcessDirectory did not return error for non-existent directory")
+	var logBuf bytes.Buffer
+	logger := log.New(&syncWriter{w: &logBuf}, "", 0)
+	config := Config{General: GeneralConfig{Workers: 3}, Directories: dirs}
+	err = RunDirectories(context.Background(), config, logger)
+	if err == nil || !strings.Contains(err.Error(), "1 of 5 directories failed") {
+		t.Errorf("RunDirectories() returned %v, want one failure", err)
 	}
-
-	// Test case 5: Test with an invalid retention period
-	dirConfig.Path = testRoot
-	dirConfig.RetentionPeriod = "invalid"
-	err = ProcessDirectory(dirConfig, securityConfig, logger)
-	if err == nil {
-		t.Errorf("ProcessDirectory did not return error for invalid retention period")
+	for _, oldFile := range oldFiles {
+		if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+			t.Errorf("Expired file %s was not deleted", oldFile)
+		}
 	}
 
-	// Test case 6: Test with ObfuscateFilenames enabled
-	// Recreate the test structure
-	oldFile = filepath.Join(testRoot, "sensitive-file.log")
-	if err := os.WriteFile(oldFile, []byte("test content"), 0644); err != nil {
-		t.Fatalf("Failed to create test file %s: %v", oldFile, err)
+	// Every line of a directory carries its path
+	for _, line := range strings.Split(strings.TrimSpace(logBuf.String()), "\n") {
+		if strings.Contains(line, "Deleted file: ") {
+			path := strings.SplitN(line, "Deleted file: ", 2)[1]
+			if !strings.HasPrefix(line, "["+filepath.Dir(path)+"] ") {
+				t.Errorf("Log line is not prefixed with its directory: %s", line)
+			}
+		}
 	}
-	if err := os.Chtimes(oldFile, oldTime, oldTime); err != nil {
-		t.Fatalf("Failed to set old file time: %v", err)
+}
+
+// syncWriter serializes writes from several goroutines
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// TestRunLock tests that runs exclude each other through the lock file
+func TestRunLock(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "filekeeper-lock-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
 	}
+	defer os.RemoveAll(tempDir)
 
-	emptySubDir = filepath.Join(testRoot, "sensitive-empty-dir")
-	if err := os.Mkdir(emptySubDir, 0755); err != nil {
-		t.Fatalf("Failed to create empty subdirectory: %v", err)
+	lockPath := filepath.Join(tempDir, "run", "filekeeper.lock")
+	lock, err := AcquireRunLock(lockPath, false)
+	if err != nil {
+		t.Fatalf("AcquireRunLock() returned error: %v", err)
 	}
 
-	dirConfig.Path = testRoot
-	dirConfig.RetentionPeriod = "7d"
-	dirConfig.FilePattern = "*.log"
-	dirConfig.ExcludeSubdirs = false
-	dirConfig.RemoveEmptyDirs = true
+	// A second run without waiting fails and names the holder
+	_, err = AcquireRunLock(lockPath, false)
+	if err == nil {
+		t.Fatal("AcquireRunLock() succeeded while the lock was held")
+	}
+	if want := fmt.Sprintf("pid %d", os.Getpid()); !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), lockPath) {
+		t.Errorf("AcquireRunLock() error = %q, want it to name %s and the lock file", err, want)
+	}
 
-	securityConfig.DryRun = false
-	securityConfig.SecureDelete.Enabled = false
-	securityConfig.SecureDelete.ObfuscateFilenames = true
+	// A waiting run gets the lock once it is released
+	acquired := make(chan *RunLock)
+	go func() {
+		waiting, err := AcquireRunLock(lockPath, true)
+		if err != nil {
+			t.Errorf("AcquireRunLock() with wait returned error: %v", err)
+		}
+		acquired <- waiting
+	}()
 
-	err = ProcessDirectory(dirConfig, securityConfig, logger)
-	if err != nil {
-		t.Errorf("ProcessDirectory with ObfuscateFilenames returned error: %v", err)
+	select {
+	case <-acquired:
+		t.Fatal("Waiting run got the lock while it was held")
+	case <-time.After(200 * time.Millisecond):
 	}
+	lock.Release()
 
-	// Verify old file was deleted
-	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
-		t.Errorf("Sensitive file still exists after processing with ObfuscateFilenames")
+	select {
+	case waiting := <-acquired:
+		waiting.Release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiting run did not get the lock after it was released")
 	}
 
-	// Verify empty directory was removed
-	if _, err := os.Stat(emptySubDir); !os.IsNotExist(err) {
-		t.Errorf("Sensitive empty directory still exists after processing with ObfuscateFilenames")
+	// The lock file is kept for the next run
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Errorf("Lock file was removed: %v", err)
 	}
+	lock, err = AcquireRunLock(lockPath, false)
+	if err != nil {
+		t.Fatalf("AcquireRunLock() after release returned error: %v", err)
+	}
+	lock.Release()
 }
 
 // TestSecureDeleteFile tests the secure file deletion functionality
@@ -568,9 +3572,9 @@ func TestSecureDeleteFile(t *testing.T) {
 	logger := log.New(io.Discard, "", 0)
 
 	// Test secure delete with 1 pass
-	err = secureDeleteFile(tempFile.Name(), 1, logger)
+	err = shredFile(context.Background(), nil, tempFile.Name(), 1, nil, logger)
 	if err != nil {
-		t.Errorf("secureDeleteFile returned error: %v", err)
+		t.Errorf("shredFile returned error: %v", err)
 	}
 
 	// Verify the file is deleted
@@ -591,7 +3595,7 @@ func TestSecureDeleteFile(t *testing.T) {
 	}
 	tempFile2.Close()
 
-	// Create a modified version of secureDeleteFile that allows us to inspect content between passes
+	// Create a modified version of shredFile that allows us to inspect content between passes
 	testSecureDelete := func(path string, passes int) error {
 		// Open the file for writing
 		file, err := os.OpenFile(path, os.O_RDWR, 0)
@@ -679,7 +3683,7 @@ func TestSecureDeleteFile(t *testing.T) {
 	// Test with 3 passes and content verification
 	err = testSecureDelete(tempFile2.Name(), 3)
 	if err != nil {
-		t.Errorf("secureDeleteFile with 3 passes returned error: %v", err)
+		t.Errorf("shredFile with 3 passes returned error: %v", err)
 	}
 
 	// Verify the file is deleted
@@ -688,9 +3692,9 @@ func TestSecureDeleteFile(t *testing.T) {
 	}
 
 	// Test with non-existent file
-	err = secureDeleteFile("/nonexistent-file-for-test", 1, logger)
+	err = shredFile(context.Background(), nil, "/nonexistent-file-for-test", 1, nil, logger)
 	if err == nil {
-		t.Errorf("secureDeleteFile did not return error for non-existent file")
+		t.Errorf("shredFile did not return error for non-existent file")
 	}
 
 	// Test with 0 passes (should handle gracefully)
@@ -701,9 +3705,9 @@ func TestSecureDeleteFile(t *testing.T) {
 	defer os.Remove(tempFile3.Name()) // This will only execute if the test fails
 
 	tempFile3.Close()
-	err = secureDeleteFile(tempFile3.Name(), 0, logger)
+	err = shredFile(context.Background(), nil, tempFile3.Name(), 0, nil, logger)
 	if err != nil {
-		t.Errorf("secureDeleteFile with 0 passes returned error: %v", err)
+		t.Errorf("shredFile with 0 passes returned error: %v", err)
 	}
 
 	// Verify the file is deleted
@@ -712,6 +3716,253 @@ func TestSecureDeleteFile(t *testing.T) {
 	}
 }
 
+// TestHardlinkSecureDelete tests the handling of hard-linked files during secure deletion
+func TestHardlinkSecureDelete(t *testing.T) {
+	testRoot, err := os.MkdirTemp("", "filekeeper-hardlink-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testRoot)
+
+	// The processed directory and a directory outside the run
+	dataDir := filepath.Join(testRoot, "data")
+	outsideDir := filepath.Join(testRoot, "outside")
+	for _, dir := range []string{dataDir, outsideDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Failed to create directory %s: %v", dir, err)
+		}
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	oldTime := time.Now().Add(-10 * 24 * time.Hour)
+	testData := "hard-linked content"
+
+	// createLinked creates a file in dataDir with a second link at linkPath
+	createLinked := func(name, linkPath string) string {
+		path := filepath.Join(dataDir, name)
+		if err := os.WriteFile(path, []byte(testData), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		if err := os.Link(path, linkPath); err != nil {
+			t.Fatalf("Failed to create hard link: %v", err)
+		}
+		for _, p := range []string{path, linkPath} {
+			if err := os.Chtimes(p, oldTime, oldTime); err != nil {
+				t.Fatalf("Failed to set file time: %v", err)
+			}
+		}
+		return path
+	}
+
+	dirConfig := DirectoryConfig{
+		Path:            dataDir,
+		RetentionPeriod: "7d",
+		FilePattern:     "*.log",
+		AllowMassDelete: true,
+	}
+	securityConfig := SecurityConfig{
+		SecureDelete: SecureDeleteConfig{
+			Enabled: true,
+			Passes:  1,
+		},
+	}
+
+	testCases := []struct {
+		policy        string
+		keepFile      bool
+		outsideIntact bool
+	}{
+		{HardlinkPolicySkip, true, true},
+		{HardlinkPolicyUnlink, false, true},
+		{HardlinkPolicyShred, false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			outsidePath := filepath.Join(outsideDir, tc.policy+".log")
+			path := createLinked(tc.policy+".log", outsidePath)
+
+			securityConfig.SecureDelete.HardlinkPolicy = tc.policy
+			if err := ProcessDirectory(dirConfig, securityConfig, logger); err != nil {
+				t.Fatalf("ProcessDirectory returned error: %v", err)
+			}
+
+			_, err := os.Stat(path)
+			if tc.keepFile && err != nil {
+				t.Errorf("File was deleted with hardlink_policy %s", tc.policy)
+			}
+			if !tc.keepFile && !os.IsNotExist(err) {
+				t.Errorf("File still exists with hardlink_policy %s", tc.policy)
+			}
+
+			content, err := os.ReadFile(outsidePath)
+			if err != nil {
+				t.Fatalf("Link outside the run was removed: %v", err)
+			}
+			if intact := string(content) == testData; intact != tc.outsideIntact {
+				t.Errorf("Link outside the run intact = %v, want %v", intact, tc.outsideIntact)
+			}
+		})
+	}
+
+	// All links inside the run are handled as one inode and removed
+	first := createLinked("first.log", filepath.Join(dataDir, "second.log"))
+	securityConfig.SecureDelete.HardlinkPolicy = HardlinkPolicySkip
+	if err := ProcessDirectory(dirConfig, securityConfig, logger); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+	for _, path := range []string{first, filepath.Join(dataDir, "second.log")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Hard link %s still exists although all links were expired", path)
+		}
+	}
+
+	// Links found by different directory entries of a run are one inode too
+	otherDir := filepath.Join(testRoot, "other")
+	if err := os.Mkdir(otherDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory %s: %v", otherDir, err)
+	}
+	shared := createLinked("shared.log", filepath.Join(otherDir, "shared.log"))
+	var logBuf bytes.Buffer
+	otherConfig := dirConfig
+	otherConfig.Path = otherDir
+	config := Config{Security: securityConfig, Directories: []DirectoryConfig{dirConfig, otherConfig}}
+	if err := RunDirectories(context.Background(), config, log.New(&logBuf, "", 0)); err != nil {
+		t.Fatalf("RunDirectories returned error: %v", err)
+	}
+	for _, path := range []string{shared, filepath.Join(otherDir, "shared.log")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Hard link %s found by two entries still exists", path)
+		}
+	}
+	if strings.Contains(logBuf.String(), "outside this run") || !strings.Contains(logBuf.String(), "All 2 hard links") {
+		t.Errorf("Links found by two entries were logged as:\n%s", logBuf.String())
+	}
+
+	// Invalid policy
+	securityConfig.SecureDelete.HardlinkPolicy = "invalid"
+	if err := ProcessDirectory(dirConfig, securityConfig, logger); err == nil {
+		t.Error("ProcessDirectory did not return error for invalid hardlink policy")
+	}
+}
+
+// TestSecureDeleteWorkers tests parallel secure deletion and the throughput limit
+func TestSecureDeleteWorkers(t *testing.T) {
+	testRoot, err := os.MkdirTemp("", "filekeeper-workers-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(testRoot)
+
+	// Create a set of expired files
+	oldTime := time.Now().Add(-10 * 24 * time.Hour)
+	var files []string
+	for i := 0; i < 20; i++ {
+		file := filepath.Join(testRoot, fmt.Sprintf("file-%d.log", i))
+		if err := os.WriteFile(file, bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		if err := os.Chtimes(file, oldTime, oldTime); err != nil {
+			t.Fatalf("Failed to set file time: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	dirConfig := DirectoryConfig{
+		Path:            testRoot,
+		RetentionPeriod: "7d",
+		AllowMassDelete: true,
+	}
+	securityConfig := SecurityConfig{
+		SecureDelete: SecureDeleteConfig{
+			Enabled:           true,
+			Passes:            2,
+			Workers:           4,
+			MaxBytesPerSecond: "100MB",
+		},
+	}
+
+	if err := ProcessDirectory(dirConfig, securityConfig, logger); err != nil {
+		t.Fatalf("ProcessDirectory returned error: %v", err)
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("File %s still exists after parallel secure deletion", file)
+		}
+	}
+
+	// Invalid throughput limit
+	securityConfig.SecureDelete.MaxBytesPerSecond = "fast"
+	if err := ProcessDirectory(dirConfig, securityConfig, logger); err == nil {
+		t.Error("ProcessDirectory did not return error for invalid max_bytes_per_second")
+	}
+
+	// Throttle spreads writes over time: 3 x 10KB at 100KB/s takes at least 200ms
+	limiter := &throttle{rate: 100 << 10}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.wait(10 << 10)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Throttled writes took %v, want at least 200ms", elapsed)
+	}
+
+	// A directory's rate is limited within the run's throttle
+	run := &throttle{rate: 1 << 20}
+	runCtx := context.WithValue(context.Background(), throttleKey{}, run)
+	same, err := shredThrottleFor(runCtx, SecureDeleteConfig{MaxBytesPerSecond: "1024K"})
+	if err != nil {
+		t.Fatalf("shredThrottleFor returned error: %v", err)
+	}
+	if same != run {
+		t.Error("shredThrottleFor did not return the run's throttle for the same rate")
+	}
+	if slower, _ := shredThrottleFor(runCtx, SecureDeleteConfig{MaxBytesPerSecond: "512K"}); slower == nil || slower.parent != run {
+		t.Error("shredThrottleFor did not nest a different rate within the run's throttle")
+	}
+	if unlimited, _ := shredThrottleFor(runCtx, SecureDeleteConfig{MaxBytesPerSecond: "0"}); unlimited != run {
+		t.Error("shredThrottleFor did not apply the run's throttle to an unlimited directory")
+	}
+	if unlimited, _ := shredThrottleFor(context.Background(), SecureDeleteConfig{MaxBytesPerSecond: "0"}); unlimited != nil {
+		t.Error("shredThrottleFor returned a throttle for an unlimited rate")
+	}
+
+	// Directories processed in parallel share the run's overwrite workers
+	var dirs []DirectoryConfig
+	for i := 0; i < 3; i++ {
+		dir := filepath.Join(testRoot, fmt.Sprintf("dir-%d", i))
+		for j := 0; j < 4; j++ {
+			writeOldFile(t, filepath.Join(dir, fmt.Sprintf("file-%d.log", j)))
+		}
+		dirs = append(dirs, DirectoryConfig{Path: dir, RetentionPeriod: "7d", AllowMassDelete: true})
+	}
+	var mu sync.Mutex
+	var running, most int
+	testHookBeforeDelete = func(path string) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+	defer func() { testHookBeforeDelete = nil }()
+	securityConfig.SecureDelete.Workers = 2
+	securityConfig.SecureDelete.MaxBytesPerSecond = ""
+	config := Config{General: GeneralConfig{Workers: 3}, Security: securityConfig, Directories: dirs}
+	if err := RunDirectories(context.Background(), config, logger); err != nil {
+		t.Fatalf("RunDirectories returned error: %v", err)
+	}
+	if most > 2 {
+		t.Errorf("%d files were overwritten at the same time, want at most 2", most)
+	}
+}
+
 // hashContent creates a simple hash of file content for comparison
 func hashContent(data []byte) string {
 	var hash uint32
@@ -1012,6 +4263,19 @@ func TestSetupLogger(t *testing.T) {
 			}
 		}
 	}
+
+	// Test case 5: Levels are case-insensitive, and unknown ones fall back to info
+	upperConfig := LoggingConfig{Enabled: true, Level: "DEBUG", File: filepath.Join(tempDir, "upper.log")}
+	if _, err := setupLogger(upperConfig); err != nil {
+		t.Errorf("setupLogger with level DEBUG returned error: %v", err)
+	}
+	unknownConfig := LoggingConfig{Enabled: true, Level: "warning", File: filepath.Join(tempDir, "unknown.log")}
+	if _, err := setupLogger(unknownConfig); err != nil {
+		t.Errorf("setupLogger with an unknown level returned error: %v", err)
+	}
+	if content, _ := os.ReadFile(unknownConfig.File); !strings.Contains(string(content), "invalid logging level 'warning'") {
+		t.Errorf("Unknown level was not logged: %s", content)
+	}
 }
 
 // TestPrintSystemdTemplates tests the PrintSystemdTemplates function
@@ -1230,6 +4494,8 @@ func initConfigPaths() {
 	if isRoot {
 		configDir = "/etc/filekeeper"
 		configFile = filepath.Join(configDir, "filekeeper.yaml")
+		dropInDir = filepath.Join(configDir, "conf.d")
+		lockFile = "/run/filekeeper.lock"
 	} else {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
@@ -1237,6 +4503,8 @@ func initConfigPaths() {
 		}
 		configDir = filepath.Join(homeDir, ".config")
 		configFile = filepath.Join(configDir, "filekeeper.yaml")
+		dropInDir = filepath.Join(configDir, "filekeeper.d")
+		lockFile = filepath.Join(configDir, "filekeeper.lock")
 	}
 }
 
@@ -1315,12 +4583,16 @@ func TestInitFunction(t *testing.T) {
 	origIsRoot := isRoot
 	origConfigDir := configDir
 	origConfigFile := configFile
+	origDropInDir := dropInDir
+	origLockFile := lockFile
 
 	// Restore after test
 	defer func() {
 		isRoot = origIsRoot
 		configDir = origConfigDir
 		configFile = origConfigFile
+		dropInDir = origDropInDir
+		lockFile = origLockFile
 	}()
 
 	// Test cases for different user types
@@ -1391,6 +4663,12 @@ func TestInitFunction(t *testing.T) {
 				if configFile != "/etc/filekeeper/filekeeper.yaml" {
 					t.Errorf("Root config file = %s, want /etc/filekeeper/filekeeper.yaml", configFile)
 				}
+				if dropInDir != "/etc/filekeeper/conf.d" {
+					t.Errorf("Root drop-in dir = %s, want /etc/filekeeper/conf.d", dropInDir)
+				}
+				if lockFile != "/run/filekeeper.lock" {
+					t.Errorf("Root lock file = %s, want /run/filekeeper.lock", lockFile)
+				}
 			} else {
 				homeDir, _ := os.UserHomeDir()
 				expectedDir := filepath.Join(homeDir, ".config")
@@ -1402,6 +4680,12 @@ func TestInitFunction(t *testing.T) {
 				if configFile != expectedFile {
 					t.Errorf("User config file = %s, want %s", configFile, expectedFile)
 				}
+				if expected := filepath.Join(homeDir, ".config", "filekeeper.d"); dropInDir != expected {
+					t.Errorf("User drop-in dir = %s, want %s", dropInDir, expected)
+				}
+				if expected := filepath.Join(homeDir, ".config", "filekeeper.lock"); lockFile != expected {
+					t.Errorf("User lock file = %s, want %s", lockFile, expected)
+				}
 			}
 		})
 	}